@@ -0,0 +1,114 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Label placed on each ECRSecret created by a ClusterECRSecret, naming the ClusterECRSecret
+const LabelClusterECRSecret = "secrets.fireflycons.io/cluster-ecrsecret"
+
+// NamespaceSyncState is the state of the ECRSecret in one selected namespace
+// +kubebuilder:validation:Enum=Synced;Pending;Suspended;Conflict;Failed
+type NamespaceSyncState string
+
+const (
+	// The secret has been generated and is being rotated
+	NamespaceSyncStateSynced NamespaceSyncState = "Synced"
+	// The ECRSecret has been created but has not yet generated its secret
+	NamespaceSyncStatePending NamespaceSyncState = "Pending"
+	// Rotation is suspended
+	NamespaceSyncStateSuspended NamespaceSyncState = "Suspended"
+	// An ECRSecret of the same name not created by this resource is in the namespace
+	NamespaceSyncStateConflict NamespaceSyncState = "Conflict"
+	// The ECRSecret could not be created or updated
+	NamespaceSyncStateFailed NamespaceSyncState = "Failed"
+)
+
+// ClusterECRSecretSpec defines the desired state of ClusterECRSecret
+type ClusterECRSecretSpec struct {
+	// Spec of the ECRSecret created in each selected namespace
+	Template ECRSecretSpec `json:"template"`
+	// Namespaces to create the secret in. An empty selector selects all namespaces.
+	// If omitted, only includeNamespaces are selected
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Namespaces to create the secret in regardless of namespaceSelector
+	// +optional
+	IncludeNamespaces []string `json:"includeNamespaces,omitempty"`
+	// Namespaces never to create the secret in. Takes precedence over namespaceSelector and includeNamespaces
+	// +optional
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+}
+
+// NamespaceStatus is the sync state of the secret in one selected namespace
+type NamespaceStatus struct {
+	Namespace string             `json:"namespace"`
+	State     NamespaceSyncState `json:"state"`
+	// When the secret in the namespace was last updated
+	// +optional
+	LastUpdated *metav1.Time `json:"lastUpdated,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ClusterECRSecretStatus defines the observed state of ClusterECRSecret
+type ClusterECRSecretStatus struct {
+	// State of the secret in each selected namespace
+	// +listType=map
+	// +listMapKey=namespace
+	// +optional
+	Namespaces []NamespaceStatus `json:"namespaces,omitempty"`
+	// Number of selected namespaces
+	// +optional
+	SelectedNamespaces int `json:"selectedNamespaces"`
+	// Number of selected namespaces where the secret is in sync
+	// +optional
+	SyncedNamespaces int `json:"syncedNamespaces"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:storageversion
+//+kubebuilder:printcolumn:name="Registry",type=string,JSONPath=`.spec.template.registry`
+//+kubebuilder:printcolumn:name="Selected",type=integer,JSONPath=`.status.selectedNamespaces`
+//+kubebuilder:printcolumn:name="Synced",type=integer,JSONPath=`.status.syncedNamespaces`
+
+// ClusterECRSecret is the Schema for the clusterecrsecrets API.
+// It creates an ECRSecret of the same name in each selected namespace.
+type ClusterECRSecret struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterECRSecretSpec   `json:"spec,omitempty"`
+	Status ClusterECRSecretStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterECRSecretList contains a list of ClusterECRSecret
+type ClusterECRSecretList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterECRSecret `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterECRSecret{}, &ClusterECRSecretList{})
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"strings"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// SetupWebhookWithManager registers the defaulting webhook, and the validating webhook
+// if a validator is given. Validation needs the cluster and operator configuration,
+// so is implemented outside the API package.
+func (e *ECRSecret) SetupWebhookWithManager(mgr ctrl.Manager, validator admission.CustomValidator) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(e).
+		WithValidator(validator).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-secrets-fireflycons-io-v1-ecrsecret,mutating=true,failurePolicy=fail,sideEffects=None,groups=secrets.fireflycons.io,resources=ecrsecrets,verbs=create;update,versions=v1,name=mecrsecret.secrets.fireflycons.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &ECRSecret{}
+
+// Default fills in the name of the generated secret, so that it is visible in the spec
+func (e *ECRSecret) Default() {
+
+	// Names are not yet generated at admission, so the name is left to the reconciler
+	if len(strings.TrimSpace(e.Spec.SecretName)) == 0 && e.Name != "" {
+		e.Spec.SecretName = e.KubeSecretName()
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package v1beta1
+
+import (
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+)
+
+// ConvertTo converts this ClusterECRSecret to the hub version
+func (src *ClusterECRSecret) ConvertTo(dstRaw conversion.Hub) error {
+
+	dst := dstRaw.(*secretsv1.ClusterECRSecret)
+	in := src.DeepCopy()
+
+	dst.ObjectMeta = in.ObjectMeta
+	dst.Spec = secretsv1.ClusterECRSecretSpec{
+		Template:          specToV1(in.Spec.Template),
+		NamespaceSelector: in.Spec.NamespaceSelector,
+		IncludeNamespaces: in.Spec.IncludeNamespaces,
+		ExcludeNamespaces: in.Spec.ExcludeNamespaces,
+	}
+	dst.Status = secretsv1.ClusterECRSecretStatus{
+		SelectedNamespaces: in.Status.SelectedNamespaces,
+		SyncedNamespaces:   in.Status.SyncedNamespaces,
+	}
+
+	if in.Status.Namespaces != nil {
+		dst.Status.Namespaces = make([]secretsv1.NamespaceStatus, 0, len(in.Status.Namespaces))
+	}
+
+	for _, namespace := range in.Status.Namespaces {
+		dst.Status.Namespaces = append(dst.Status.Namespaces, secretsv1.NamespaceStatus{
+			Namespace:   namespace.Namespace,
+			State:       secretsv1.NamespaceSyncState(namespace.State),
+			LastUpdated: namespace.LastUpdated,
+			Message:     namespace.Message,
+		})
+	}
+
+	return nil
+}
+
+// ConvertFrom converts from the hub version to this ClusterECRSecret
+func (dst *ClusterECRSecret) ConvertFrom(srcRaw conversion.Hub) error {
+
+	in := srcRaw.(*secretsv1.ClusterECRSecret).DeepCopy()
+
+	dst.ObjectMeta = in.ObjectMeta
+	dst.Spec = ClusterECRSecretSpec{
+		Template:          specFromV1(in.Spec.Template),
+		NamespaceSelector: in.Spec.NamespaceSelector,
+		IncludeNamespaces: in.Spec.IncludeNamespaces,
+		ExcludeNamespaces: in.Spec.ExcludeNamespaces,
+	}
+	dst.Status = ClusterECRSecretStatus{
+		SelectedNamespaces: in.Status.SelectedNamespaces,
+		SyncedNamespaces:   in.Status.SyncedNamespaces,
+	}
+
+	if in.Status.Namespaces != nil {
+		dst.Status.Namespaces = make([]NamespaceStatus, 0, len(in.Status.Namespaces))
+	}
+
+	for _, namespace := range in.Status.Namespaces {
+		dst.Status.Namespaces = append(dst.Status.Namespaces, NamespaceStatus{
+			Namespace:   namespace.Namespace,
+			State:       NamespaceSyncState(namespace.State),
+			LastUpdated: namespace.LastUpdated,
+			Message:     namespace.Message,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package v1beta1
+
+import (
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+)
+
+// ConvertTo converts this ECRSecret to the hub version
+func (src *ECRSecret) ConvertTo(dstRaw conversion.Hub) error {
+
+	dst := dstRaw.(*secretsv1.ECRSecret)
+	in := src.DeepCopy()
+
+	dst.ObjectMeta = in.ObjectMeta
+	dst.Spec = specToV1(in.Spec)
+	dst.Status = secretsv1.ECRSecretStatus{
+		LastUpdated:               in.Status.LastUpdated,
+		LastHandledRefreshRequest: in.Status.LastHandledRefreshRequest,
+		Conditions:                in.Status.Conditions,
+	}
+
+	if in.Status.Usage != nil {
+		dst.Status.Usage = &secretsv1.SecretUsage{
+			Pods:            in.Status.Usage.Pods,
+			ServiceAccounts: in.Status.Usage.ServiceAccounts,
+			LastUsed:        in.Status.Usage.LastUsed,
+		}
+	}
+
+	return nil
+}
+
+// ConvertFrom converts from the hub version to this ECRSecret
+func (dst *ECRSecret) ConvertFrom(srcRaw conversion.Hub) error {
+
+	in := srcRaw.(*secretsv1.ECRSecret).DeepCopy()
+
+	dst.ObjectMeta = in.ObjectMeta
+	dst.Spec = specFromV1(in.Spec)
+	dst.Status = ECRSecretStatus{
+		LastUpdated:               in.Status.LastUpdated,
+		LastHandledRefreshRequest: in.Status.LastHandledRefreshRequest,
+		Conditions:                in.Status.Conditions,
+	}
+
+	if in.Status.Usage != nil {
+		dst.Status.Usage = &SecretUsage{
+			Pods:            in.Status.Usage.Pods,
+			ServiceAccounts: in.Status.Usage.ServiceAccounts,
+			LastUsed:        in.Status.Usage.LastUsed,
+		}
+	}
+
+	return nil
+}
+
+// Convert a spec to v1. Pointers are shared, so the spec should be a deep copy.
+func specToV1(in ECRSecretSpec) secretsv1.ECRSecretSpec {
+
+	out := secretsv1.ECRSecretSpec{
+		Registry:            in.Registry,
+		SecretName:          in.SecretName,
+		DeletionPolicy:      secretsv1.DeletionPolicy(in.DeletionPolicy),
+		Suspend:             in.Suspend,
+		MaxAge:              in.MaxAge,
+		RefreshBefore:       in.RefreshBefore,
+		Format:              secretsv1.SecretFormat(in.Format),
+		ConfigKey:           in.ConfigKey,
+		RegistryAliases:     aliasesToV1(in.RegistryAliases),
+		SecretType:          secretsv1.SecretType(in.SecretType),
+		Merge:               in.Merge,
+		AdditionalAuthsFrom: in.AdditionalAuthsFrom,
+	}
+
+	if in.ArgoCD != nil {
+		out.ArgoCD = &secretsv1.ArgoCDSpec{
+			SecretType: in.ArgoCD.SecretType,
+			URL:        in.ArgoCD.URL,
+			Name:       in.ArgoCD.Name,
+		}
+	}
+
+	if in.Jenkins != nil {
+		out.Jenkins = &secretsv1.JenkinsSpec{
+			Description: in.Jenkins.Description,
+		}
+	}
+
+	if in.SecretTemplate != nil {
+		out.SecretTemplate = &secretsv1.SecretTemplate{
+			Metadata: secretsv1.SecretTemplateMetadata{
+				Labels:      in.SecretTemplate.Metadata.Labels,
+				Annotations: in.SecretTemplate.Metadata.Annotations,
+			},
+		}
+	}
+
+	if in.ServiceAccounts != nil {
+		out.ServiceAccounts = &secretsv1.ServiceAccountSelector{
+			Names:    in.ServiceAccounts.Names,
+			Selector: in.ServiceAccounts.Selector,
+		}
+	}
+
+	return out
+}
+
+// Convert a v1 spec to this version. Pointers are shared, so the spec should be a deep copy.
+func specFromV1(in secretsv1.ECRSecretSpec) ECRSecretSpec {
+
+	out := ECRSecretSpec{
+		Registry:            in.Registry,
+		SecretName:          in.SecretName,
+		DeletionPolicy:      DeletionPolicy(in.DeletionPolicy),
+		Suspend:             in.Suspend,
+		MaxAge:              in.MaxAge,
+		RefreshBefore:       in.RefreshBefore,
+		Format:              SecretFormat(in.Format),
+		ConfigKey:           in.ConfigKey,
+		RegistryAliases:     aliasesFromV1(in.RegistryAliases),
+		SecretType:          SecretType(in.SecretType),
+		Merge:               in.Merge,
+		AdditionalAuthsFrom: in.AdditionalAuthsFrom,
+	}
+
+	if in.ArgoCD != nil {
+		out.ArgoCD = &ArgoCDSpec{
+			SecretType: in.ArgoCD.SecretType,
+			URL:        in.ArgoCD.URL,
+			Name:       in.ArgoCD.Name,
+		}
+	}
+
+	if in.Jenkins != nil {
+		out.Jenkins = &JenkinsSpec{
+			Description: in.Jenkins.Description,
+		}
+	}
+
+	if in.SecretTemplate != nil {
+		out.SecretTemplate = &SecretTemplate{
+			Metadata: SecretTemplateMetadata{
+				Labels:      in.SecretTemplate.Metadata.Labels,
+				Annotations: in.SecretTemplate.Metadata.Annotations,
+			},
+		}
+	}
+
+	if in.ServiceAccounts != nil {
+		out.ServiceAccounts = &ServiceAccountSelector{
+			Names:    in.ServiceAccounts.Names,
+			Selector: in.ServiceAccounts.Selector,
+		}
+	}
+
+	return out
+}
+
+// Convert registry aliases to v1, keeping nil as nil
+func aliasesToV1(in []RegistryAlias) []secretsv1.RegistryAlias {
+
+	if in == nil {
+		return nil
+	}
+
+	out := make([]secretsv1.RegistryAlias, len(in))
+
+	for i, alias := range in {
+		out[i] = secretsv1.RegistryAlias(alias)
+	}
+
+	return out
+}
+
+// Convert v1 registry aliases to this version, keeping nil as nil
+func aliasesFromV1(in []secretsv1.RegistryAlias) []RegistryAlias {
+
+	if in == nil {
+		return nil
+	}
+
+	out := make([]RegistryAlias, len(in))
+
+	for i, alias := range in {
+		out[i] = RegistryAlias(alias)
+	}
+
+	return out
+}
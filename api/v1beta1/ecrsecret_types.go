@@ -17,27 +17,230 @@ limitations under the License.
 package v1beta1
 
 import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// DeletionPolicy determines what happens to the generated kube secret when the ECRSecret is deleted
+// +kubebuilder:validation:Enum=Delete;Retain
+type DeletionPolicy string
+
+const (
+	// Delete the generated secret along with the ECRSecret (default)
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+
+	// Keep the generated secret, removing the owner reference and marking it as orphaned
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+)
+
+// Set this annotation on an ECRSecret to a new value (e.g. a timestamp) to force a token refresh
+const AnnotationRefreshRequestedAt = "secrets.fireflycons.io/refresh-requested-at"
+
+// Label placed on each ECRSecret the operator creates for a registry discovered in a namespace's workloads
+const LabelDiscovered = "secrets.fireflycons.io/discovered"
+
+// Condition types reported in ECRSecretStatus
+const (
+	// Token rotation and drift repair are suspended
+	ConditionSuspended = "Suspended"
+	// ECR auth has been merged into the user-managed secret named by secretName
+	ConditionMerged = "Merged"
+	// Nothing has referenced the generated secret for the operator's --unused-after period
+	ConditionUnused = "Unused"
+)
+
+// SecretFormat determines how the auth data is laid out in the generated secret
+// +kubebuilder:validation:Enum=DockerConfigJson;Opaque;DockerConfigFile;ArgoCD;Flux;Tekton;Jenkins
+type SecretFormat string
+
+const (
+	// kubernetes.io/dockerconfigjson secret suitable for imagePullSecrets (default)
+	SecretFormatDockerConfigJson SecretFormat = "DockerConfigJson"
+
+	// Opaque secret with username, password, registry and expiresAt keys
+	SecretFormatOpaque SecretFormat = "Opaque"
+
+	// Opaque secret with the docker config document under configKey, for Kaniko and BuildKit
+	SecretFormatDockerConfigFile SecretFormat = "DockerConfigFile"
+
+	// Argo CD repository credential for Helm charts stored in ECR as OCI artifacts
+	SecretFormatArgoCD SecretFormat = "ArgoCD"
+
+	// Secret for Flux HelmRepository (type oci) and OCIRepository sources
+	SecretFormatFlux SecretFormat = "Flux"
+
+	// kubernetes.io/basic-auth secret annotated for Tekton credential initialization
+	SecretFormatTekton SecretFormat = "Tekton"
+
+	// Username and password credential for the Jenkins Kubernetes Credentials Provider
+	SecretFormatJenkins SecretFormat = "Jenkins"
+)
+
+// ArgoCDSpec describes the Argo CD repository credential generated when format is ArgoCD
+type ArgoCDSpec struct {
+	// Value of the argocd.argoproj.io/secret-type label. Use repo-creds for a credential template
+	// that applies to all repositories under url
+	// +kubebuilder:validation:Enum=repository;repo-creds
+	// +kubebuilder:default=repository
+	// +optional
+	SecretType string `json:"secretType,omitempty"`
+	// Repository URL. Defaults to the registry host
+	// +optional
+	URL string `json:"url,omitempty"`
+	// Repository name shown in Argo CD
+	// +optional
+	Name string `json:"name,omitempty"`
+}
+
+// JenkinsSpec describes the Jenkins credential generated when format is Jenkins
+type JenkinsSpec struct {
+	// Credential description shown in Jenkins. Defaults to a description naming the registry
+	// +optional
+	Description string `json:"description,omitempty"`
+}
+
+// RegistryAlias is an additional registry key in docker config. It is a host name,
+// optionally with a scheme, port and path.
+// +kubebuilder:validation:MinLength=1
+// +kubebuilder:validation:Pattern=`^(https?://)?[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]{1,5})?(/[^\s]*)?$`
+type RegistryAlias string
+
+// SecretType is the kubernetes secret type for docker config formats
+// +kubebuilder:validation:Enum=kubernetes.io/dockerconfigjson;kubernetes.io/dockercfg
+type SecretType string
+
+const (
+	// Secret with a .dockerconfigjson key (default)
+	SecretTypeDockerConfigJson SecretType = "kubernetes.io/dockerconfigjson"
+
+	// Legacy secret with a .dockercfg key
+	SecretTypeDockercfg SecretType = "kubernetes.io/dockercfg"
+)
+
+// ServiceAccountSelector selects service accounts in the namespace to reference the generated secret.
+// A service account is selected if it is named or matches the selector.
+type ServiceAccountSelector struct {
+	// Names of service accounts
+	// +optional
+	Names []string `json:"names,omitempty"`
+	// Label selector for service accounts
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// SecretUsage counts what references the generated secret as an image pull secret
+type SecretUsage struct {
+	// Number of running or pending pods that reference the secret
+	Pods int32 `json:"pods"`
+	// Number of service accounts that reference the secret
+	ServiceAccounts int32 `json:"serviceAccounts"`
+	// When the secret was last seen referenced
+	// +optional
+	LastUsed *metav1.Time `json:"lastUsed,omitempty"`
+}
+
+// SecretTemplateMetadata holds labels and annotations to apply to the generated secret
+type SecretTemplateMetadata struct {
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// SecretTemplate describes how the generated secret should be decorated
+type SecretTemplate struct {
+	// +optional
+	Metadata SecretTemplateMetadata `json:"metadata,omitempty"`
+}
+
 // ECRSecretSpec defines the desired state of ECRSecret
+// +kubebuilder:validation:XValidation:rule="!has(self.secretType) || !has(self.format) || self.format == 'DockerConfigJson'",message="secretType can only be set when format is DockerConfigJson"
+// +kubebuilder:validation:XValidation:rule="!has(self.configKey) || (has(self.format) && self.format == 'DockerConfigFile')",message="configKey can only be set when format is DockerConfigFile"
+// +kubebuilder:validation:XValidation:rule="!has(self.argoCD) || (has(self.format) && self.format == 'ArgoCD')",message="argoCD can only be set when format is ArgoCD"
+// +kubebuilder:validation:XValidation:rule="!has(self.jenkins) || (has(self.format) && self.format == 'Jenkins')",message="jenkins can only be set when format is Jenkins"
+// +kubebuilder:validation:XValidation:rule="!has(self.merge) || !self.merge || ((!has(self.format) || self.format == 'DockerConfigJson') && !has(self.secretType) && !has(self.secretTemplate))",message="merge can only be used with format DockerConfigJson, and not with secretType or secretTemplate"
+// +kubebuilder:validation:XValidation:rule="!has(self.additionalAuthsFrom) || ((!has(self.format) || self.format == 'DockerConfigJson' || self.format == 'DockerConfigFile') && !(has(self.merge) && self.merge))",message="additionalAuthsFrom can only be set when format is DockerConfigJson or DockerConfigFile, and not with merge"
+// +kubebuilder:validation:XValidation:rule="!has(self.serviceAccounts) || !has(self.format) || self.format == 'DockerConfigJson' || self.format == 'Flux'",message="serviceAccounts can only be set when format is DockerConfigJson or Flux"
 type ECRSecretSpec struct {
 	// +kubebuilder:validation:Pattern=`^\d{12}\.dkr.ecr.(ap|ca|eu|sa|us(-gov)?)-(east|northeast|southeast|north|south|southeast|central|west)-\d\.amazonaws\.com$`
 	Registry string `json:"registry,omitempty"`
 	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
 	SecretName string `json:"secretName,omitempty"`
+	// What to do with the generated secret when this resource is deleted
+	// +kubebuilder:default=Delete
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// Suspend token rotation and drift repair for this resource
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+	// Maximum age of the secret before it is rotated. Overrides the operator's --max-age
+	// +kubebuilder:validation:XValidation:rule="duration(self) > duration('0s') && duration(self) <= duration('12h')",message="maxAge must be greater than zero and no more than the 12h ECR token lifetime"
+	// +optional
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+	// Rotate the secret when the token has no more than this long left to run
+	// +kubebuilder:validation:XValidation:rule="duration(self) > duration('0s') && duration(self) < duration('12h')",message="refreshBefore must be greater than zero and less than the 12h ECR token lifetime"
+	// +optional
+	RefreshBefore *metav1.Duration `json:"refreshBefore,omitempty"`
+	// Layout of the generated secret
+	// +kubebuilder:default=DockerConfigJson
+	// +optional
+	Format SecretFormat `json:"format,omitempty"`
+	// Data key for the docker config document when format is DockerConfigFile. Defaults to config.json
+	// +kubebuilder:validation:Pattern=`^[-._a-zA-Z0-9]+$`
+	// +optional
+	ConfigKey string `json:"configKey,omitempty"`
+	// Argo CD repository settings when format is ArgoCD
+	// +optional
+	ArgoCD *ArgoCDSpec `json:"argoCD,omitempty"`
+	// Jenkins credential settings when format is Jenkins
+	// +optional
+	Jenkins *JenkinsSpec `json:"jenkins,omitempty"`
+	// Additional registry keys in docker config, such as the bare host name or a CNAME fronting ECR,
+	// that map to the same credential
+	// +optional
+	// +listType=set
+	RegistryAliases []RegistryAlias `json:"registryAliases,omitempty"`
+	// Secret type when format is DockerConfigJson. Use kubernetes.io/dockercfg for older tools that only read .dockercfg
+	// +optional
+	SecretType SecretType `json:"secretType,omitempty"`
+	// Labels and annotations applied to the generated secret on creation and kept on every rotation
+	// +optional
+	SecretTemplate *SecretTemplate `json:"secretTemplate,omitempty"`
+	// Merge the ECR auth into an existing docker config secret named by secretName, which is not owned by the operator
+	// +optional
+	Merge bool `json:"merge,omitempty"`
+	// Docker config secrets in the same namespace whose registry auths are added to the generated docker config.
+	// Where a registry appears in more than one, the ECR auth takes precedence, then the earliest secret listed
+	// +optional
+	AdditionalAuthsFrom []corev1.LocalObjectReference `json:"additionalAuthsFrom,omitempty"`
+	// Service accounts in the namespace to add the generated secret to as an image pull secret
+	// +optional
+	ServiceAccounts *ServiceAccountSelector `json:"serviceAccounts,omitempty"`
 }
 
 // ECRSecretStatus defines the observed state of ECRSecret
 type ECRSecretStatus struct {
 	LastUpdated *metav1.Time `json:"lastUpdated,omitempty"`
+	// Value of the refresh-requested-at annotation when the secret was last refreshed
+	// +optional
+	LastHandledRefreshRequest string `json:"lastHandledRefreshRequest,omitempty"`
+	// What references the generated secret. Only tracked for image pull secrets.
+	// +optional
+	Usage *SecretUsage `json:"usage,omitempty"`
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:deprecatedversion:warning="secrets.fireflycons.io/v1beta1 ECRSecret is deprecated; use secrets.fireflycons.io/v1 ECRSecret"
 
 // ECRSecret is the Schema for the ecrsecrets API
 type ECRSecret struct {
@@ -48,6 +251,16 @@ type ECRSecret struct {
 	Status ECRSecretStatus `json:"status,omitempty"`
 }
 
+// KubeSecretName gets the name of the kube secret that holds the ECR auth for this resource
+func (e *ECRSecret) KubeSecretName() string {
+
+	if len(strings.TrimSpace(e.Spec.SecretName)) > 0 {
+		return e.Spec.SecretName
+	}
+
+	return e.Name + "-secret"
+}
+
 //+kubebuilder:object:root=true
 
 // ECRSecretList contains a list of ECRSecret
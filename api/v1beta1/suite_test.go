@@ -0,0 +1,145 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package v1beta1
+
+import (
+	"testing"
+	"time"
+
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	fuzz "github.com/google/gofuzz"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Number of random objects to round trip
+const FUZZ_ITERATIONS = 200
+
+func TestV1beta1(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "API v1beta1 Suite")
+}
+
+var _ = Describe("Conversion", func() {
+
+	// TypeMeta is set by the API server, so is not converted
+	fuzzer := fuzz.New().NilChance(0.2).Funcs(
+		func(t *metav1.TypeMeta, c fuzz.Continue) {},
+	)
+
+	Context("ECRSecret", func() {
+
+		It("Should convert to v1", func() {
+			maxAge := metav1.Duration{Duration: 4 * time.Hour}
+			src := &ECRSecret{
+				ObjectMeta: metav1.ObjectMeta{Name: "ecr", Namespace: "default"},
+				Spec: ECRSecretSpec{
+					Registry:        "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+					Format:          SecretFormatArgoCD,
+					ArgoCD:          &ArgoCDSpec{SecretType: "repo-creds"},
+					DeletionPolicy:  DeletionPolicyRetain,
+					MaxAge:          &maxAge,
+					RegistryAliases: []RegistryAlias{"ecr.example.com"},
+				},
+				Status: ECRSecretStatus{
+					Usage: &SecretUsage{Pods: 2},
+				},
+			}
+
+			dst := &secretsv1.ECRSecret{}
+			Expect(src.ConvertTo(dst)).To(Succeed())
+
+			Expect(dst.Name).To(Equal("ecr"))
+			Expect(dst.Spec.Registry).To(Equal(src.Spec.Registry))
+			Expect(dst.Spec.Format).To(Equal(secretsv1.SecretFormatArgoCD))
+			Expect(dst.Spec.ArgoCD.SecretType).To(Equal("repo-creds"))
+			Expect(dst.Spec.DeletionPolicy).To(Equal(secretsv1.DeletionPolicyRetain))
+			Expect(dst.Spec.MaxAge.Duration).To(Equal(maxAge.Duration))
+			Expect(dst.Spec.RegistryAliases).To(Equal([]secretsv1.RegistryAlias{"ecr.example.com"}))
+			Expect(dst.Status.Usage.Pods).To(Equal(int32(2)))
+			Expect(dst.KubeSecretName()).To(Equal("ecr-secret"))
+
+			// The source is not shared with the result
+			dst.Spec.RegistryAliases[0] = "changed"
+			Expect(src.Spec.RegistryAliases[0]).To(Equal(RegistryAlias("ecr.example.com")))
+		})
+
+		It("Should round trip from v1beta1", func() {
+			for i := 0; i < FUZZ_ITERATIONS; i++ {
+				original := &ECRSecret{}
+				fuzzer.Fuzz(original)
+
+				hub := &secretsv1.ECRSecret{}
+				Expect(original.ConvertTo(hub)).To(Succeed())
+
+				converted := &ECRSecret{}
+				Expect(converted.ConvertFrom(hub)).To(Succeed())
+
+				Expect(converted).To(Equal(original))
+			}
+		})
+
+		It("Should round trip from v1", func() {
+			for i := 0; i < FUZZ_ITERATIONS; i++ {
+				original := &secretsv1.ECRSecret{}
+				fuzzer.Fuzz(original)
+
+				spoke := &ECRSecret{}
+				Expect(spoke.ConvertFrom(original)).To(Succeed())
+
+				converted := &secretsv1.ECRSecret{}
+				Expect(spoke.ConvertTo(converted)).To(Succeed())
+
+				Expect(converted).To(Equal(original))
+			}
+		})
+	})
+
+	Context("ClusterECRSecret", func() {
+
+		It("Should round trip from v1beta1", func() {
+			for i := 0; i < FUZZ_ITERATIONS; i++ {
+				original := &ClusterECRSecret{}
+				fuzzer.Fuzz(original)
+
+				hub := &secretsv1.ClusterECRSecret{}
+				Expect(original.ConvertTo(hub)).To(Succeed())
+
+				converted := &ClusterECRSecret{}
+				Expect(converted.ConvertFrom(hub)).To(Succeed())
+
+				Expect(converted).To(Equal(original))
+			}
+		})
+
+		It("Should round trip from v1", func() {
+			for i := 0; i < FUZZ_ITERATIONS; i++ {
+				original := &secretsv1.ClusterECRSecret{}
+				fuzzer.Fuzz(original)
+
+				spoke := &ClusterECRSecret{}
+				Expect(spoke.ConvertFrom(original)).To(Succeed())
+
+				converted := &secretsv1.ClusterECRSecret{}
+				Expect(spoke.ConvertTo(converted)).To(Succeed())
+
+				Expect(converted).To(Equal(original))
+			}
+		})
+	})
+})
@@ -0,0 +1,309 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// ClusterECRSecretReconciler reconciles a ClusterECRSecret object
+type ClusterECRSecretReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=secrets.fireflycons.io,resources=clusterecrsecrets,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=secrets.fireflycons.io,resources=clusterecrsecrets/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=secrets.fireflycons.io,resources=clusterecrsecrets/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// Reconcile creates, updates and removes the ECRSecret in each namespace selected by the ClusterECRSecret.
+// The ECRSecrets do the work of generating and rotating the kube secrets. They are owned by the
+// ClusterECRSecret, so are garbage collected along with it.
+func (r *ClusterECRSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	log.V(5).Info("Begin reconciler")
+
+	var clusterSecret secretsv1.ClusterECRSecret
+
+	if err := r.Get(ctx, req.NamespacedName, &clusterSecret); err != nil {
+		if apierrs.IsNotFound(err) {
+			log.V(5).Info("Unable to fetch ClusterECRSecret - probably just deleted.")
+			return ctrl.Result{}, nil
+		}
+
+		log.Error(err, "unable to fetch ClusterECRSecret")
+		return ctrl.Result{}, err
+	}
+
+	if !clusterSecret.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	selected, err := r.getSelectedNamespaces(ctx, &clusterSecret)
+
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	children := secretsv1.ECRSecretList{}
+
+	if err = r.List(ctx, &children, client.MatchingLabels{secretsv1.LabelClusterECRSecret: clusterSecret.Name}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Remove from namespaces that are no longer selected
+	for i := range children.Items {
+
+		child := &children.Items[i]
+
+		if selected[child.Namespace] || !metav1.IsControlledBy(child, &clusterSecret) {
+			continue
+		}
+
+		log.Info("Namespace no longer selected. Removing ECRSecret", "ClusterECRSecret", clusterSecret.Name, "Namespace", child.Namespace)
+
+		if err = r.Delete(ctx, child); client.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	statuses := make([]secretsv1.NamespaceStatus, 0, len(selected))
+
+	for namespace := range selected {
+		statuses = append(statuses, r.syncNamespace(ctx, &clusterSecret, namespace))
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Namespace < statuses[j].Namespace })
+
+	return ctrl.Result{}, r.setStatus(ctx, &clusterSecret, statuses)
+}
+
+// Get the names of the namespaces the ClusterECRSecret selects
+func (r *ClusterECRSecretReconciler) getSelectedNamespaces(ctx context.Context, clusterSecret *secretsv1.ClusterECRSecret) (map[string]bool, error) {
+
+	selector := labels.Nothing()
+
+	if clusterSecret.Spec.NamespaceSelector != nil {
+
+		var err error
+
+		if selector, err = metav1.LabelSelectorAsSelector(clusterSecret.Spec.NamespaceSelector); err != nil {
+			return nil, err
+		}
+	}
+
+	namespaces := corev1.NamespaceList{}
+
+	if err := r.List(ctx, &namespaces); err != nil {
+		return nil, err
+	}
+
+	return selectNamespaces(clusterSecret, selector, namespaces.Items), nil
+}
+
+// Apply the selector and the include and exclude lists to the namespaces.
+// Namespaces that are being deleted are never selected.
+func selectNamespaces(clusterSecret *secretsv1.ClusterECRSecret, selector labels.Selector, namespaces []corev1.Namespace) map[string]bool {
+
+	included := map[string]bool{}
+
+	for _, name := range clusterSecret.Spec.IncludeNamespaces {
+		included[name] = true
+	}
+
+	excluded := map[string]bool{}
+
+	for _, name := range clusterSecret.Spec.ExcludeNamespaces {
+		excluded[name] = true
+	}
+
+	selected := map[string]bool{}
+
+	for _, ns := range namespaces {
+
+		if excluded[ns.Name] || ns.Status.Phase == corev1.NamespaceTerminating {
+			continue
+		}
+
+		if included[ns.Name] || selector.Matches(labels.Set(ns.Labels)) {
+			selected[ns.Name] = true
+		}
+	}
+
+	return selected
+}
+
+// Create or update the ECRSecret in one namespace and report its state
+func (r *ClusterECRSecretReconciler) syncNamespace(ctx context.Context, clusterSecret *secretsv1.ClusterECRSecret, namespace string) secretsv1.NamespaceStatus {
+
+	log := log.FromContext(ctx)
+
+	status := secretsv1.NamespaceStatus{Namespace: namespace}
+
+	failed := func(err error) secretsv1.NamespaceStatus {
+		log.Error(err, "Unable to sync ECRSecret", "ClusterECRSecret", clusterSecret.Name, "Namespace", namespace)
+		status.State = secretsv1.NamespaceSyncStateFailed
+		status.Message = err.Error()
+		return status
+	}
+
+	// Default the spec as the defaulting webhook would, so that it compares equal to the child's
+	desired := &secretsv1.ECRSecret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      clusterSecret.Name,
+			Namespace: namespace,
+			Labels:    map[string]string{secretsv1.LabelClusterECRSecret: clusterSecret.Name},
+		},
+		Spec: *clusterSecret.Spec.Template.DeepCopy(),
+	}
+
+	desired.Default()
+
+	child := &secretsv1.ECRSecret{}
+	err := r.Get(ctx, types.NamespacedName{Name: clusterSecret.Name, Namespace: namespace}, child)
+
+	if apierrs.IsNotFound(err) {
+
+		child = desired
+
+		if err = ctrl.SetControllerReference(clusterSecret, child, r.Scheme); err != nil {
+			return failed(err)
+		}
+
+		log.Info("Creating ECRSecret", "ClusterECRSecret", clusterSecret.Name, "Namespace", namespace)
+
+		if err = r.Create(ctx, child); err != nil {
+			return failed(err)
+		}
+
+		status.State = secretsv1.NamespaceSyncStatePending
+		return status
+	}
+
+	if err != nil {
+		return failed(err)
+	}
+
+	if !metav1.IsControlledBy(child, clusterSecret) {
+		status.State = secretsv1.NamespaceSyncStateConflict
+		status.Message = fmt.Sprintf("ECRSecret '%s' already exists and is not managed by this ClusterECRSecret", child.Name)
+		return status
+	}
+
+	if !equality.Semantic.DeepEqual(child.Spec, desired.Spec) {
+
+		log.Info("Updating ECRSecret", "ClusterECRSecret", clusterSecret.Name, "Namespace", namespace)
+		child.Spec = desired.Spec
+
+		if err = r.Update(ctx, child); err != nil {
+			return failed(err)
+		}
+	}
+
+	status.LastUpdated = child.Status.LastUpdated
+
+	switch {
+	case meta.IsStatusConditionTrue(child.Status.Conditions, secretsv1.ConditionSuspended):
+		status.State = secretsv1.NamespaceSyncStateSuspended
+	case child.Status.LastUpdated == nil:
+		status.State = secretsv1.NamespaceSyncStatePending
+	default:
+		status.State = secretsv1.NamespaceSyncStateSynced
+	}
+
+	if cond := meta.FindStatusCondition(child.Status.Conditions, secretsv1.ConditionMerged); cond != nil && cond.Status == metav1.ConditionFalse {
+		status.State = secretsv1.NamespaceSyncStateFailed
+		status.Message = cond.Message
+	}
+
+	return status
+}
+
+// Write the per-namespace states to the status, if they have changed
+func (r *ClusterECRSecretReconciler) setStatus(ctx context.Context, clusterSecret *secretsv1.ClusterECRSecret, statuses []secretsv1.NamespaceStatus) error {
+
+	synced := 0
+
+	for _, status := range statuses {
+		if status.State == secretsv1.NamespaceSyncStateSynced {
+			synced++
+		}
+	}
+
+	newStatus := secretsv1.ClusterECRSecretStatus{
+		Namespaces:         statuses,
+		SelectedNamespaces: len(statuses),
+		SyncedNamespaces:   synced,
+	}
+
+	if equality.Semantic.DeepEqual(clusterSecret.Status, newStatus) {
+		return nil
+	}
+
+	clusterSecret.Status = newStatus
+
+	return r.Status().Update(ctx, clusterSecret)
+}
+
+// Any namespace event may change which namespaces a ClusterECRSecret selects, so reconcile them all
+func (r *ClusterECRSecretReconciler) mapNamespace(obj client.Object) []reconcile.Request {
+
+	list := secretsv1.ClusterECRSecretList{}
+
+	if err := r.List(context.Background(), &list); err != nil {
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(list.Items))
+
+	for _, clusterSecret := range list.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: clusterSecret.Name},
+		})
+	}
+
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ClusterECRSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&secretsv1.ClusterECRSecret{}).
+		Owns(&secretsv1.ECRSecret{}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}}, handler.EnqueueRequestsFromMapFunc(r.mapNamespace)).
+		Complete(r)
+}
@@ -23,16 +23,18 @@ import (
 	"strings"
 	"time"
 
-	secretsv1beta1 "github.com/fireflycons/ecr-secret-operator/api/v1beta1"
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
 	"github.com/fireflycons/ecr-secret-operator/internal/aws"
 	"github.com/fireflycons/ecr-secret-operator/internal/clock"
 	"github.com/fireflycons/ecr-secret-operator/internal/config"
 	"github.com/fireflycons/ecr-secret-operator/internal/ksecret"
 	corev1 "k8s.io/api/core/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
@@ -48,7 +50,8 @@ type ECRSecretReconciler struct {
 	ConfigFile string
 	MaxAge     time.Duration
 	clock.Clock
-	Auth aws.ECRAuthentication
+	Auth     aws.ECRAuthentication
+	Recorder record.EventRecorder
 }
 
 //+kubebuilder:rbac:groups=secrets.fireflycons.io,resources=ecrsecrets,verbs="*"
@@ -57,6 +60,8 @@ type ECRSecretReconciler struct {
 //+kubebuilder:rbac:groups="",resources=secrets,verbs="*"
 //+kubebuilder:rbac:groups="",resources=secrets/status,verbs=get
 //+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -74,7 +79,7 @@ func (r *ECRSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 
 	var (
 		emptyResult = ctrl.Result{}
-		ecrSecret   secretsv1beta1.ECRSecret
+		ecrSecret   secretsv1.ECRSecret
 	)
 
 	// Retrieve the custom resource
@@ -92,6 +97,35 @@ func (r *ECRSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return emptyResult, err
 	}
 
+	// Apply the deletion policy if the resource is going away
+	if deleting, err := r.handleDeletion(ctx, &ecrSecret); deleting || err != nil {
+		return emptyResult, err
+	}
+
+	// While suspended, leave the secret exactly as it is. The service accounts
+	// referencing it are still kept in step with the selection.
+	if ecrSecret.Spec.Suspend {
+		log.V(5).Info("Rotation is suspended")
+		r.setCondition(ctx, &ecrSecret, metav1.Condition{
+			Type:    secretsv1.ConditionSuspended,
+			Status:  metav1.ConditionTrue,
+			Reason:  "Suspended",
+			Message: "Token rotation and drift repair are suspended",
+		})
+		return emptyResult, r.syncServiceAccounts(ctx, &ecrSecret)
+	}
+
+	if meta.IsStatusConditionTrue(ecrSecret.Status.Conditions, secretsv1.ConditionSuspended) {
+		// Resuming. The checks below will catch up on any rotation missed while suspended.
+		log.Info("Rotation resumed", "ECRSecret", ecrSecret.Name)
+		r.setCondition(ctx, &ecrSecret, metav1.Condition{
+			Type:    secretsv1.ConditionSuspended,
+			Status:  metav1.ConditionFalse,
+			Reason:  "Resumed",
+			Message: "Token rotation has resumed",
+		})
+	}
+
 	// Determine AWS account ID and region from registy property of spec
 	// Not used yet: account ID
 	accountId, region := func(registry string) (string, string) {
@@ -132,6 +166,24 @@ func (r *ECRSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return emptyResult, err
 	}
 
+	// A user-managed secret only has our auth merged into it
+	if ecrSecret.Spec.Merge {
+		return r.reconcileMergedSecret(ctx, &ecrSecret)
+	}
+
+	layout := getSecretLayout(&ecrSecret)
+
+	// Secrets we can't read are left out rather than holding up rotation.
+	// We'll be called again by the secret watch when they are fixed.
+	additionalAuths, authErrs := r.getAdditionalAuths(ctx, &ecrSecret)
+
+	for _, authErr := range authErrs {
+		log.Error(authErr, "Unable to get additional auths", "ECRSecret", ecrSecret.Name)
+	}
+
+	layout.AdditionalAuths = additionalAuths
+	r.setAdditionalAuthsCondition(ctx, &ecrSecret, authErrs)
+
 	foundSecret := &corev1.Secret{}
 
 	// Look for existing owned kube secret
@@ -141,8 +193,8 @@ func (r *ECRSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		// If we get here, need to create a new secret
 		var secret *corev1.Secret
 
-		log.V(5).Info("Creating new docker-registry secret", "Name", getKubeSecretName(&ecrSecret))
-		secret, err = constructSecret(r, &ecrSecret, &r.Auth, r.Clock)
+		log.V(5).Info("Creating new secret", "Name", getKubeSecretName(&ecrSecret))
+		secret, err = constructSecret(r, &ecrSecret, layout, &r.Auth, r.Clock)
 
 		if err != nil {
 			return emptyResult, err
@@ -157,18 +209,66 @@ func (r *ECRSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 			return emptyResult, err
 		}
 
+		r.removeCondition(ctx, &ecrSecret, secretsv1.ConditionConflict)
 		r.setStatus(ctx, &ecrSecret)
-		log.Info("Created new docker-registry secret", "ECRSecret", ecrSecret.Name, "Secret", secret.Name, "uuid", fmt.Sprintf("%v", id))
+		log.Info("Created new secret", "ECRSecret", ecrSecret.Name, "Secret", secret.Name, "uuid", fmt.Sprintf("%v", id))
 
 	} else if err == nil {
 
 		// Some crud operation has happened to the owned secret, or we received a renewal event
 
-		if ksecret.IsChanged(foundSecret) || ksecret.IsExpired(foundSecret, r.MaxAge, r.Clock) {
+		if !ksecret.IsManagedBy(foundSecret, ecrSecret.Name) {
+			return emptyResult, r.handleUnmanagedSecret(ctx, &ecrSecret, foundSecret)
+		}
+
+		r.removeCondition(ctx, &ecrSecret, secretsv1.ConditionConflict)
+
+		if foundSecret.Type != ksecret.GetSecretType(layout) {
+			// Secret type is immutable, so the secret must be recreated
+			log.Info("Secret type has changed. Recreating secret", "secret", foundSecret.Name, "Type", ksecret.GetSecretType(layout))
+			err = r.Delete(ctx, foundSecret)
+			return ctrl.Result{Requeue: true}, err
+		}
+
+		// A secret retained by a previously deleted ECRSecret is taken back into ownership
+		var adopted bool
+
+		if adopted, err = r.adoptSecret(&ecrSecret, foundSecret); err != nil {
+			return emptyResult, err
+		}
+
+		if adopted {
+			log.Info("Adopting retained secret", "ECRSecret", ecrSecret.Name, "Secret", foundSecret.Name)
+		}
+
+		// A refresh has been requested that we have not yet acted on
+		refreshRequest := ecrSecret.Annotations[secretsv1.AnnotationRefreshRequestedAt]
+		refreshRequested := refreshRequest != "" && refreshRequest != ecrSecret.Status.LastHandledRefreshRequest
+
+		if refreshRequested {
+			log.Info("Refresh requested", "ECRSecret", ecrSecret.Name, "RequestedAt", refreshRequest)
+		}
+
+		maxAge, windowErr := getRotationAge(&ecrSecret, foundSecret, r.MaxAge)
+
+		layoutChanged := ksecret.IsLayoutChanged(foundSecret, layout)
+
+		if adopted || refreshRequested || layoutChanged || ksecret.IsChanged(foundSecret) || ksecret.IsExpired(foundSecret, maxAge, r.Clock) {
+			if windowErr != nil {
+				// Reported once per token rather than on every reconcile
+				log.Error(windowErr, "Invalid rotation window. Using the default", "ECRSecret", ecrSecret.Name, "MaxAge", maxAge)
+			}
+
 			// Owned secret has drifted from desired state or has expired
 			// Update to required state - effectively regenerate the secret
+			if layoutChanged {
+				// Drop what the previous layout required. The secret template and current layout put back what is still needed.
+				ksecret.RemoveLayoutMetadata(foundSecret)
+			}
+
+			applySecretMetadata(&ecrSecret, layout, foundSecret)
 
-			if err = ksecret.UpdateSecret(&r.Auth, foundSecret, r.Clock); err == nil {
+			if err = ksecret.UpdateSecret(&r.Auth, foundSecret, layout, r.Clock); err == nil {
 				log.Info("Updating secret", "secret", foundSecret.Name)
 				err = r.Update(ctx, foundSecret)
 
@@ -176,13 +276,21 @@ func (r *ECRSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 					r.setStatus(ctx, &ecrSecret)
 				}
 			}
+		} else if applySecretMetadata(&ecrSecret, layout, foundSecret) {
+			// Only the labels and annotations are out of step, so no need for a new token
+			log.Info("Applying secret metadata", "secret", foundSecret.Name)
+			err = r.Update(ctx, foundSecret)
 		}
 	}
 
+	if err == nil {
+		err = r.syncServiceAccounts(ctx, &ecrSecret)
+	}
+
 	return emptyResult, err
 }
 
-func (r *ECRSecretReconciler) setStatus(ctx context.Context, ecrSecret *secretsv1beta1.ECRSecret) {
+func (r *ECRSecretReconciler) setStatus(ctx context.Context, ecrSecret *secretsv1.ECRSecret) {
 
 	// Status updates
 	// https://heidloff.net/article/storing-state-status-kubernetes-resources-conditions-operators-go/
@@ -191,11 +299,55 @@ func (r *ECRSecretReconciler) setStatus(ctx context.Context, ecrSecret *secretsv
 
 	log.V(5).Info("Updating status")
 	ecrSecret.Status.LastUpdated = &metav1.Time{Time: time.Now()}
+
+	// Any pending refresh request has been satisfied by this update
+	ecrSecret.Status.LastHandledRefreshRequest = ecrSecret.Annotations[secretsv1.AnnotationRefreshRequestedAt]
+	err := r.Client.Status().Update(ctx, ecrSecret)
+
+	if err != nil {
+		log.Info("ECRSecret resourse status update failed.")
+	}
+}
+
+// Remove a status condition, writing the status only if it was present
+func (r *ECRSecretReconciler) removeCondition(ctx context.Context, ecrSecret *secretsv1.ECRSecret, conditionType string) {
+
+	if meta.FindStatusCondition(ecrSecret.Status.Conditions, conditionType) == nil {
+		return
+	}
+
+	meta.RemoveStatusCondition(&ecrSecret.Status.Conditions, conditionType)
+
+	if err := r.Client.Status().Update(ctx, ecrSecret); err != nil {
+		log.FromContext(ctx).Info("ECRSecret resourse status update failed.")
+	}
+}
+
+// Set a status condition, writing the status only if the condition has changed.
+// Returns true if the condition changed.
+func (r *ECRSecretReconciler) setCondition(ctx context.Context, ecrSecret *secretsv1.ECRSecret, condition metav1.Condition) bool {
+
+	log := log.FromContext(ctx)
+
+	condition.ObservedGeneration = ecrSecret.Generation
+	existing := meta.FindStatusCondition(ecrSecret.Status.Conditions, condition.Type)
+
+	if existing != nil &&
+		existing.Status == condition.Status &&
+		existing.Reason == condition.Reason &&
+		existing.Message == condition.Message &&
+		existing.ObservedGeneration == condition.ObservedGeneration {
+		return false
+	}
+
+	meta.SetStatusCondition(&ecrSecret.Status.Conditions, condition)
 	err := r.Client.Status().Update(ctx, ecrSecret)
 
 	if err != nil {
 		log.Info("ECRSecret resourse status update failed.")
 	}
+
+	return true
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -210,14 +362,20 @@ func (r *ECRSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		r.Auth = aws.NewECRAuthentication()
 	}
 
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("ecrsecret-controller")
+	}
+
 	// Start a polling loop to look for expiry
 	ch := make(chan event.GenericEvent)
-	updateEvent := CreateRenewalEvent(mgr.GetClient(), ch)
+	updateEvent := CreateRenewalEvent(mgr.GetClient(), ch, r.MaxAge)
 	go updateEvent.Run()
 
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&secretsv1beta1.ECRSecret{}).
+		For(&secretsv1.ECRSecret{}).
 		Watches(&source.Channel{Source: ch, DestBufferSize: 1024}, &handler.EnqueueRequestForObject{}).
 		Owns(&corev1.Secret{}). // https://github.com/kubernetes-sigs/kubebuilder/blob/master/docs/book/src/reference/watching-resources/testdata/owned-resource/controller.go
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.mapReferencedSecret)).
+		Watches(&source.Kind{Type: &corev1.ServiceAccount{}}, handler.EnqueueRequestsFromMapFunc(r.mapServiceAccount)).
 		Complete(r)
 }
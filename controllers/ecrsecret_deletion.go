@@ -0,0 +1,131 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	"github.com/fireflycons/ecr-secret-operator/internal/ksecret"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Finalizer placed on ECRSecrets so that the deletion policy can be applied
+// before the owned kube secret is garbage collected.
+const FINALIZER_NAME = "secrets.fireflycons.io/finalizer"
+
+// Ensure the finalizer is present on a live resource, or apply the deletion policy
+// and release the finalizer on one that is being deleted.
+// Returns true if the resource is being deleted and reconciliation should go no further.
+func (r *ECRSecretReconciler) handleDeletion(ctx context.Context, ecrSecret *secretsv1.ECRSecret) (bool, error) {
+
+	if ecrSecret.DeletionTimestamp.IsZero() {
+
+		if controllerutil.AddFinalizer(ecrSecret, FINALIZER_NAME) {
+			return false, r.Update(ctx, ecrSecret)
+		}
+
+		return false, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(ecrSecret, FINALIZER_NAME) {
+		// Already processed. Nothing more for us to do.
+		return true, nil
+	}
+
+	// Undo any image pull secret references we added to service accounts
+	if err := r.syncServiceAccounts(ctx, ecrSecret); err != nil {
+		return true, err
+	}
+
+	if ecrSecret.Spec.Merge {
+		if err := r.releaseMergedSecret(ctx, ecrSecret); err != nil {
+			return true, err
+		}
+	} else if ecrSecret.Spec.DeletionPolicy == secretsv1.DeletionPolicyRetain {
+		if err := r.orphanSecret(ctx, ecrSecret); err != nil {
+			return true, err
+		}
+	}
+
+	controllerutil.RemoveFinalizer(ecrSecret, FINALIZER_NAME)
+
+	return true, r.Update(ctx, ecrSecret)
+}
+
+// Detach the kube secret from the ECRSecret so that it survives garbage collection.
+// The secret is annotated with the time it was orphaned so it can be identified later.
+func (r *ECRSecretReconciler) orphanSecret(ctx context.Context, ecrSecret *secretsv1.ECRSecret) error {
+
+	log := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+
+	if err := r.Get(ctx, types.NamespacedName{Name: getKubeSecretName(ecrSecret), Namespace: ecrSecret.Namespace}, secret); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	var owners []metav1.OwnerReference
+
+	for _, ref := range secret.OwnerReferences {
+		if ref.UID != ecrSecret.UID {
+			owners = append(owners, ref)
+		}
+	}
+
+	if len(owners) == len(secret.OwnerReferences) {
+		// Not owned by this ECRSecret, so leave it alone
+		return nil
+	}
+
+	secret.OwnerReferences = owners
+
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+
+	secret.Annotations[ksecret.ANNOTATION_ORPHANED] = r.Clock.Now().UTC().Format(time.RFC3339)
+	delete(secret.Labels, ksecret.LABEL_MANAGED)
+
+	log.Info("Retaining secret", "ECRSecret", ecrSecret.Name, "Secret", secret.Name)
+
+	return r.Update(ctx, secret)
+}
+
+// Take ownership of a secret previously retained by a deleted ECRSecret of the same secret name.
+// Returns true if the secret was adopted.
+func (r *ECRSecretReconciler) adoptSecret(ecrSecret *secretsv1.ECRSecret, secret *corev1.Secret) (bool, error) {
+
+	if _, ok := secret.Annotations[ksecret.ANNOTATION_ORPHANED]; !ok || metav1.GetControllerOf(secret) != nil {
+		return false, nil
+	}
+
+	if err := controllerutil.SetControllerReference(ecrSecret, secret, r.Scheme); err != nil {
+		return false, err
+	}
+
+	delete(secret.Annotations, ksecret.ANNOTATION_ORPHANED)
+	ksecret.MergeMetadata(&secret.Labels, map[string]string{ksecret.LABEL_MANAGED: ksecret.MANAGED})
+
+	return true, nil
+}
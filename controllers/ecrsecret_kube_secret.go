@@ -17,35 +17,218 @@ limitations under the License.
 package controllers
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"strings"
+	"time"
 
-	secretsv1beta1 "github.com/fireflycons/ecr-secret-operator/api/v1beta1"
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
 	"github.com/fireflycons/ecr-secret-operator/internal/aws"
 	"github.com/fireflycons/ecr-secret-operator/internal/clock"
 	"github.com/fireflycons/ecr-secret-operator/internal/ksecret"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	ERROR_FMT_ADDITIONAL_AUTHS = "cannot read additional auths from secret '%s': %w"
+)
+
+// Reasons for the AdditionalAuths condition
+const (
+	ADDITIONAL_AUTHS_REASON_READ        = "Read"
+	ADDITIONAL_AUTHS_REASON_UNAVAILABLE = "SecretUnavailable"
 )
 
 // Max age of an ECR secret
 //var AWS_SECRET_LIFETIME = time.Hour * 12
 
 // Get the name for the Kubernetes docker-registry secret that will contain the ECR auth token
-func getKubeSecretName(ecrSecret *secretsv1beta1.ECRSecret) string {
+func getKubeSecretName(ecrSecret *secretsv1.ECRSecret) string {
+	return ecrSecret.KubeSecretName()
+}
+
+// Get the age at which the kube secret should be rotated, applying any rotation window
+// set on the ECRSecret over the operator-wide default. A window that does not fit the
+// token lifetime falls back to the default, and the error says why.
+func getRotationAge(ecrSecret *secretsv1.ECRSecret, secret *corev1.Secret, defaultMaxAge time.Duration) (time.Duration, error) {
+
+	maxAge := defaultMaxAge
+
+	if ecrSecret.Spec.MaxAge != nil {
+		maxAge = ecrSecret.Spec.MaxAge.Duration
+	}
+
+	var refreshBefore time.Duration
+
+	if ecrSecret.Spec.RefreshBefore != nil {
+		refreshBefore = ecrSecret.Spec.RefreshBefore.Duration
+	}
+
+	age, err := ksecret.GetRotationAge(secret, maxAge, refreshBefore)
+
+	if err != nil {
+		if fallback, fallbackErr := ksecret.GetRotationAge(secret, defaultMaxAge, 0); fallbackErr == nil {
+			age = fallback
+		}
+	}
+
+	return age, err
+}
+
+// Get the layout of the kube secret from the ECRSecret spec
+func getSecretLayout(ecrSecret *secretsv1.ECRSecret) ksecret.Layout {
+
+	layout := ksecret.Layout{
+		Registry:        ecrSecret.Spec.Registry,
+		Format:          string(ecrSecret.Spec.Format),
+		SecretType:      string(ecrSecret.Spec.SecretType),
+		RegistryAliases: ecrSecret.Registries()[1:],
+		ConfigKey:       ecrSecret.Spec.ConfigKey,
+	}
+
+	if argo := ecrSecret.Spec.ArgoCD; argo != nil {
+		layout.ArgoCDSecretType = argo.SecretType
+		layout.RepositoryURL = argo.URL
+		layout.RepositoryName = argo.Name
+	}
+
+	if jenkins := ecrSecret.Spec.Jenkins; jenkins != nil {
+		layout.Description = jenkins.Description
+	}
+
+	return layout
+}
+
+// Collect the registry auths from the secrets named in additionalAuthsFrom.
+// Where a registry is in more than one secret, the earliest listed wins.
+// A secret that is missing or cannot be parsed is left out, so that it does not stop the
+// ECR auth from being rotated, and the problem is returned for reporting.
+func (r *ECRSecretReconciler) getAdditionalAuths(ctx context.Context, ecrSecret *secretsv1.ECRSecret) (map[string]json.RawMessage, []error) {
+
+	if len(ecrSecret.Spec.AdditionalAuthsFrom) == 0 {
+		return nil, nil
+	}
+
+	all := map[string]json.RawMessage{}
+
+	var errs []error
+
+	for _, ref := range ecrSecret.Spec.AdditionalAuthsFrom {
+
+		secret := &corev1.Secret{}
+
+		if err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ecrSecret.Namespace}, secret); err != nil {
+			errs = append(errs, fmt.Errorf(ERROR_FMT_ADDITIONAL_AUTHS, ref.Name, err))
+			continue
+		}
+
+		auths, err := ksecret.GetDockerConfigAuths(secret)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf(ERROR_FMT_ADDITIONAL_AUTHS, ref.Name, err))
+			continue
+		}
+
+		for registry, auth := range auths {
+			if _, ok := all[registry]; !ok {
+				all[registry] = auth
+			}
+		}
+	}
+
+	return all, errs
+}
+
+// Report whether the secrets named in additionalAuthsFrom could all be read.
+// An event is raised only when the condition changes, not on every reconcile.
+func (r *ECRSecretReconciler) setAdditionalAuthsCondition(ctx context.Context, ecrSecret *secretsv1.ECRSecret, errs []error) {
+
+	if len(ecrSecret.Spec.AdditionalAuthsFrom) == 0 {
+
+		r.removeCondition(ctx, ecrSecret, secretsv1.ConditionAdditionalAuths)
+		return
+	}
+
+	if len(errs) == 0 {
+		r.setCondition(ctx, ecrSecret, metav1.Condition{
+			Type:    secretsv1.ConditionAdditionalAuths,
+			Status:  metav1.ConditionTrue,
+			Reason:  ADDITIONAL_AUTHS_REASON_READ,
+			Message: fmt.Sprintf("Auths read from %d secret(s)", len(ecrSecret.Spec.AdditionalAuthsFrom)),
+		})
+
+		return
+	}
+
+	messages := make([]string, 0, len(errs))
+
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+
+	message := strings.Join(messages, "; ")
+
+	if r.setCondition(ctx, ecrSecret, metav1.Condition{
+		Type:    secretsv1.ConditionAdditionalAuths,
+		Status:  metav1.ConditionFalse,
+		Reason:  ADDITIONAL_AUTHS_REASON_UNAVAILABLE,
+		Message: message,
+	}) {
+		r.Recorder.Event(ecrSecret, corev1.EventTypeWarning, ADDITIONAL_AUTHS_REASON_UNAVAILABLE, message)
+	}
+}
+
+// Determine whether the ECRSecret reads from or writes to the named secret other than the one it owns
+func referencesSecret(ecrSecret *secretsv1.ECRSecret, name string) bool {
+
+	if ecrSecret.Spec.Merge && getKubeSecretName(ecrSecret) == name {
+		return true
+	}
+
+	for _, ref := range ecrSecret.Spec.AdditionalAuthsFrom {
+		if ref.Name == name {
+			return true
+		}
+	}
 
-	if len(strings.TrimSpace(ecrSecret.Spec.SecretName)) > 0 {
-		return ecrSecret.Spec.SecretName
+	return false
+}
+
+// Map a secret event to the ECRSecrets in the namespace that merge into it or take auths from it
+func (r *ECRSecretReconciler) mapReferencedSecret(obj client.Object) []reconcile.Request {
+
+	list := secretsv1.ECRSecretList{}
+
+	if err := r.List(context.Background(), &list, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
 	}
 
-	return ecrSecret.Name + "-secret"
+	var requests []reconcile.Request
+
+	for i := range list.Items {
 
+		ecrSecret := &list.Items[i]
+
+		if referencesSecret(ecrSecret, obj.GetName()) {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: ecrSecret.Name, Namespace: ecrSecret.Namespace},
+			})
+		}
+	}
+
+	return requests
 }
 
 // Build the kube-secret and make it owned by this custom resource.
-func constructSecret(r *ECRSecretReconciler, owner *secretsv1beta1.ECRSecret, ecr *aws.ECRAuthentication, clock clock.Clock) (*corev1.Secret, error) {
+func constructSecret(r *ECRSecretReconciler, owner *secretsv1.ECRSecret, layout ksecret.Layout, ecr *aws.ECRAuthentication, clock clock.Clock) (*corev1.Secret, error) {
 
-	annotations, data, err := ksecret.GetSecretData(ecr, clock)
+	annotations, data, err := ksecret.GetSecretData(ecr, layout, clock)
 
 	if err != nil {
 		return nil, err
@@ -57,13 +240,48 @@ func constructSecret(r *ECRSecretReconciler, owner *secretsv1beta1.ECRSecret, ec
 			Namespace:   owner.Namespace,
 			Annotations: annotations,
 		},
-		Type: "kubernetes.io/dockerconfigjson",
+		Type: ksecret.GetSecretType(layout),
 		Data: data,
 	}
 
+	applySecretMetadata(owner, layout, secret)
+
 	if err := ctrl.SetControllerReference(owner, secret, r.Scheme); err != nil {
 		return nil, err
 	}
 
 	return secret, nil
 }
+
+// Apply the labels and annotations from the ECRSecret's secret template to the kube secret.
+// Those a previous template applied are removed once dropped from the template. Other labels
+// and annotations not named in the template are left alone, as are the operator's own
+// annotations. Returns true if the secret was modified.
+func applySecretTemplate(owner *secretsv1.ECRSecret, secret *corev1.Secret) bool {
+
+	var labels map[string]string
+	annotations := map[string]string{}
+
+	if owner.Spec.SecretTemplate != nil {
+		labels = owner.Spec.SecretTemplate.Metadata.Labels
+
+		for k, v := range owner.Spec.SecretTemplate.Metadata.Annotations {
+			if !strings.HasPrefix(k, ksecret.ANNOTATION_PREFIX) {
+				annotations[k] = v
+			}
+		}
+	}
+
+	return ksecret.ApplyTemplateMetadata(secret, labels, annotations)
+}
+
+// Apply the secret template, then the metadata the layout requires and the managed label
+// so that the template cannot override them. Returns true if the secret was modified.
+func applySecretMetadata(owner *secretsv1.ECRSecret, layout ksecret.Layout, secret *corev1.Secret) bool {
+
+	changed := applySecretTemplate(owner, secret)
+	changed = ksecret.ApplyLayoutMetadata(secret, layout) || changed
+	changed = ksecret.MergeMetadata(&secret.Labels, map[string]string{ksecret.LABEL_MANAGED: ksecret.MANAGED}) || changed
+
+	return changed
+}
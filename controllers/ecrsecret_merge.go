@@ -0,0 +1,215 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	"github.com/fireflycons/ecr-secret-operator/internal/ksecret"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Reasons for the Merged condition
+const (
+	MERGE_REASON_MERGED           = "Merged"
+	MERGE_REASON_SECRET_NOT_FOUND = "SecretNotFound"
+	MERGE_REASON_WRONG_TYPE       = "WrongSecretType"
+	MERGE_REASON_OWNED            = "SecretOwned"
+	MERGE_REASON_CONFLICT         = "MergedByOther"
+	MERGE_REASON_EXISTING_ENTRY   = "ExistingEntry"
+)
+
+// Reason for the Conflict condition
+const CONFLICT_REASON_NOT_MANAGED = "SecretNotManaged"
+
+// Keep the ECR auth merged into the user-managed docker config secret named by the ECRSecret.
+// The secret is never created or deleted by us, and anything in it we did not put there is left alone.
+func (r *ECRSecretReconciler) reconcileMergedSecret(ctx context.Context, ecrSecret *secretsv1.ECRSecret) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	// Merging into a secret we do not manage is what merge is for
+	r.removeCondition(ctx, ecrSecret, secretsv1.ConditionConflict)
+
+	secret := &corev1.Secret{}
+	secretName := getKubeSecretName(ecrSecret)
+
+	if err := r.Get(ctx, types.NamespacedName{Name: secretName, Namespace: ecrSecret.Namespace}, secret); err != nil {
+
+		if apierrs.IsNotFound(err) {
+			// We'll be called again by the secret watch when it is created
+			log.Info("Secret to merge into does not exist", "ECRSecret", ecrSecret.Name, "Secret", secretName)
+			r.setMergedCondition(ctx, ecrSecret, metav1.ConditionFalse, MERGE_REASON_SECRET_NOT_FOUND, fmt.Sprintf("Secret '%s' does not exist", secretName))
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	if reason, message := checkMergeTarget(ecrSecret, secret); reason != "" {
+		log.Info("Cannot merge into secret", "ECRSecret", ecrSecret.Name, "Secret", secretName, "Reason", message)
+		r.setMergedCondition(ctx, ecrSecret, metav1.ConditionFalse, reason, message)
+		return ctrl.Result{}, nil
+	}
+
+	layout := getSecretLayout(ecrSecret)
+
+	refreshRequest := ecrSecret.Annotations[secretsv1.AnnotationRefreshRequestedAt]
+	refreshRequested := refreshRequest != "" && refreshRequest != ecrSecret.Status.LastHandledRefreshRequest
+
+	maxAge, windowErr := getRotationAge(ecrSecret, secret, r.MaxAge)
+
+	if secret.Annotations[ksecret.ANNOTATION_MERGED_BY] == ecrSecret.Name &&
+		!refreshRequested &&
+		!ksecret.IsLayoutChanged(secret, layout) &&
+		!ksecret.IsChanged(secret) &&
+		!ksecret.IsExpired(secret, maxAge, r.Clock) {
+		r.setMergedCondition(ctx, ecrSecret, metav1.ConditionTrue, MERGE_REASON_MERGED, fmt.Sprintf("ECR auth is merged into secret '%s'", secretName))
+		return ctrl.Result{}, r.syncServiceAccounts(ctx, ecrSecret)
+	}
+
+	if windowErr != nil {
+		// Reported once per token rather than on every reconcile
+		log.Error(windowErr, "Invalid rotation window. Using the default", "ECRSecret", ecrSecret.Name, "MaxAge", maxAge)
+	}
+
+	if err := ksecret.MergeSecret(&r.Auth, secret, layout, r.Clock); err != nil {
+
+		var conflict *ksecret.MergeConflictError
+
+		if errors.As(err, &conflict) {
+			// We'll be called again by the secret watch when the entry is removed
+			log.Info("Cannot merge into secret", "ECRSecret", ecrSecret.Name, "Secret", secretName, "Reason", err.Error())
+			r.setMergedCondition(ctx, ecrSecret, metav1.ConditionFalse, MERGE_REASON_EXISTING_ENTRY, err.Error())
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	secret.Annotations[ksecret.ANNOTATION_MERGED_BY] = ecrSecret.Name
+
+	log.Info("Merging ECR auth into secret", "ECRSecret", ecrSecret.Name, "Secret", secretName)
+
+	if err := r.Update(ctx, secret); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	r.setStatus(ctx, ecrSecret)
+	r.setMergedCondition(ctx, ecrSecret, metav1.ConditionTrue, MERGE_REASON_MERGED, fmt.Sprintf("ECR auth is merged into secret '%s'", secretName))
+
+	return ctrl.Result{}, r.syncServiceAccounts(ctx, ecrSecret)
+}
+
+// Check that a secret is one we may merge into.
+// Returns the condition reason and message if it is not, else empty strings.
+func checkMergeTarget(ecrSecret *secretsv1.ECRSecret, secret *corev1.Secret) (string, string) {
+
+	if secret.Type != corev1.SecretTypeDockerConfigJson {
+		return MERGE_REASON_WRONG_TYPE, fmt.Sprintf("Secret '%s' is of type '%s', not '%s'", secret.Name, secret.Type, corev1.SecretTypeDockerConfigJson)
+	}
+
+	if owner := metav1.GetControllerOf(secret); owner != nil {
+		return MERGE_REASON_OWNED, fmt.Sprintf("Secret '%s' is controlled by %s '%s'", secret.Name, owner.Kind, owner.Name)
+	}
+
+	if mergedBy, ok := secret.Annotations[ksecret.ANNOTATION_MERGED_BY]; ok && mergedBy != ecrSecret.Name {
+		return MERGE_REASON_CONFLICT, fmt.Sprintf("Secret '%s' already has ECR auth merged by ECRSecret '%s'", secret.Name, mergedBy)
+	}
+
+	return "", ""
+}
+
+func (r *ECRSecretReconciler) setMergedCondition(ctx context.Context, ecrSecret *secretsv1.ECRSecret, status metav1.ConditionStatus, reason, message string) {
+
+	r.setCondition(ctx, ecrSecret, metav1.Condition{
+		Type:    secretsv1.ConditionMerged,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+// Leave alone a secret of the ECRSecret's secret name that it does not manage, such as one a
+// user created. If we had merged into it before merge was turned off, the merge is released
+// as on deletion, so the user's secret is not left with our auth and annotations.
+func (r *ECRSecretReconciler) handleUnmanagedSecret(ctx context.Context, ecrSecret *secretsv1.ECRSecret, secret *corev1.Secret) error {
+
+	log := log.FromContext(ctx)
+
+	if secret.Annotations[ksecret.ANNOTATION_MERGED_BY] == ecrSecret.Name {
+		if err := r.releaseMergedSecret(ctx, ecrSecret); err != nil {
+			return err
+		}
+
+		r.removeCondition(ctx, ecrSecret, secretsv1.ConditionMerged)
+	}
+
+	message := fmt.Sprintf("Secret '%s' exists and is not managed by this ECRSecret", secret.Name)
+
+	if r.setCondition(ctx, ecrSecret, metav1.Condition{
+		Type:    secretsv1.ConditionConflict,
+		Status:  metav1.ConditionTrue,
+		Reason:  CONFLICT_REASON_NOT_MANAGED,
+		Message: message,
+	}) {
+		log.Info("Not writing secret", "ECRSecret", ecrSecret.Name, "Secret", secret.Name, "Reason", message)
+	}
+
+	return nil
+}
+
+// Apply the deletion policy to a secret we have merged into.
+// Delete removes our auth and annotations. Retain leaves the auth in place but removes our annotations,
+// so the secret is no longer treated as merged.
+func (r *ECRSecretReconciler) releaseMergedSecret(ctx context.Context, ecrSecret *secretsv1.ECRSecret) error {
+
+	log := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+
+	if err := r.Get(ctx, types.NamespacedName{Name: getKubeSecretName(ecrSecret), Namespace: ecrSecret.Namespace}, secret); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	if secret.Annotations[ksecret.ANNOTATION_MERGED_BY] != ecrSecret.Name {
+		// Not merged by this ECRSecret, so leave it alone
+		return nil
+	}
+
+	if ecrSecret.Spec.DeletionPolicy == secretsv1.DeletionPolicyRetain {
+		log.Info("Retaining merged auth in secret", "ECRSecret", ecrSecret.Name, "Secret", secret.Name)
+		ksecret.ReleaseMergedSecret(secret)
+	} else {
+		log.Info("Removing merged auth from secret", "ECRSecret", ecrSecret.Name, "Secret", secret.Name)
+
+		if err := ksecret.UnmergeSecret(secret); err != nil {
+			return err
+		}
+	}
+
+	return r.Update(ctx, secret)
+}
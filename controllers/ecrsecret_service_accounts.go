@@ -0,0 +1,213 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	"github.com/fireflycons/ecr-secret-operator/internal/ksecret"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Determine whether the ECRSecret selects the service account
+func selectsServiceAccount(ecrSecret *secretsv1.ECRSecret, sa *corev1.ServiceAccount) bool {
+
+	if !ecrSecret.DeletionTimestamp.IsZero() || ecrSecret.Spec.ServiceAccounts == nil {
+		return false
+	}
+
+	for _, name := range ecrSecret.Spec.ServiceAccounts.Names {
+		if name == sa.Name {
+			return true
+		}
+	}
+
+	if ecrSecret.Spec.ServiceAccounts.Selector == nil {
+		return false
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(ecrSecret.Spec.ServiceAccounts.Selector)
+
+	// Selector is validated by the API server, so an error here selects nothing
+	return err == nil && selector.Matches(labels.Set(sa.Labels))
+}
+
+func containsString(list []string, s string) bool {
+
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Add the secret to the service account's image pull secrets if it is not already there.
+// Returns true if the service account was modified.
+func addPullSecret(sa *corev1.ServiceAccount, secretName string) bool {
+
+	for _, ref := range sa.ImagePullSecrets {
+		if ref.Name == secretName {
+			// Already referenced, either by us or by someone else
+			return false
+		}
+	}
+
+	sa.ImagePullSecrets = append(sa.ImagePullSecrets, corev1.LocalObjectReference{Name: secretName})
+
+	if added := ksecret.GetAddedPullSecrets(sa); !containsString(added, secretName) {
+		ksecret.SetAddedPullSecrets(sa, append(added, secretName))
+	}
+
+	return true
+}
+
+// Remove the secrets for which remove returns true from the service account's image pull
+// secrets, if we added them. Returns true if the service account was modified.
+func removePullSecrets(sa *corev1.ServiceAccount, remove func(secretName string) bool) bool {
+
+	var removed, remaining []string
+
+	for _, name := range ksecret.GetAddedPullSecrets(sa) {
+		if remove(name) {
+			removed = append(removed, name)
+		} else {
+			remaining = append(remaining, name)
+		}
+	}
+
+	if len(removed) == 0 {
+		return false
+	}
+
+	var refs []corev1.LocalObjectReference
+
+	for _, ref := range sa.ImagePullSecrets {
+		if !containsString(removed, ref.Name) {
+			refs = append(refs, ref)
+		}
+	}
+
+	sa.ImagePullSecrets = refs
+	ksecret.SetAddedPullSecrets(sa, remaining)
+
+	return true
+}
+
+// Make the selected service accounts in the namespace reference the secret, and remove
+// the reference we added from any that are no longer selected. When the ECRSecret is
+// being deleted, no service accounts are selected so all our references are removed.
+// References we added to secrets that no ECRSecret in the namespace now generates, such
+// as the old name when secretName is changed, are removed too.
+func (r *ECRSecretReconciler) syncServiceAccounts(ctx context.Context, ecrSecret *secretsv1.ECRSecret) error {
+
+	log := log.FromContext(ctx)
+
+	secretName := getKubeSecretName(ecrSecret)
+	serviceAccounts := corev1.ServiceAccountList{}
+
+	if err := r.List(ctx, &serviceAccounts, client.InNamespace(ecrSecret.Namespace)); err != nil {
+		return err
+	}
+
+	ecrSecrets := secretsv1.ECRSecretList{}
+
+	if err := r.List(ctx, &ecrSecrets, client.InNamespace(ecrSecret.Namespace)); err != nil {
+		return err
+	}
+
+	// Secret names still wanted by the other ECRSecrets in the namespace
+	inUse := map[string]bool{}
+
+	for i := range ecrSecrets.Items {
+		if other := &ecrSecrets.Items[i]; other.Name != ecrSecret.Name && other.DeletionTimestamp.IsZero() {
+			inUse[getKubeSecretName(other)] = true
+		}
+	}
+
+	for i := range serviceAccounts.Items {
+
+		sa := &serviceAccounts.Items[i]
+
+		selected := selectsServiceAccount(ecrSecret, sa)
+
+		changed := removePullSecrets(sa, func(name string) bool {
+			if name == secretName {
+				return !selected
+			}
+
+			return !inUse[name]
+		})
+
+		if selected {
+			changed = addPullSecret(sa, secretName) || changed
+		}
+
+		if !changed {
+			continue
+		}
+
+		log.Info("Updating service account image pull secrets", "ECRSecret", ecrSecret.Name, "ServiceAccount", sa.Name)
+
+		if err := r.Update(ctx, sa); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Map a service account event to the ECRSecrets in the namespace that select it or have added to it
+func (r *ECRSecretReconciler) mapServiceAccount(obj client.Object) []reconcile.Request {
+
+	sa, ok := obj.(*corev1.ServiceAccount)
+
+	if !ok {
+		return nil
+	}
+
+	list := secretsv1.ECRSecretList{}
+
+	if err := r.List(context.Background(), &list, client.InNamespace(sa.Namespace)); err != nil {
+		return nil
+	}
+
+	added := ksecret.GetAddedPullSecrets(sa)
+
+	var requests []reconcile.Request
+
+	for i := range list.Items {
+
+		ecrSecret := &list.Items[i]
+
+		if selectsServiceAccount(ecrSecret, sa) || containsString(added, getKubeSecretName(ecrSecret)) {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: ecrSecret.Name, Namespace: ecrSecret.Namespace},
+			})
+		}
+	}
+
+	return requests
+}
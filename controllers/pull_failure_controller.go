@@ -0,0 +1,336 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	"github.com/fireflycons/ecr-secret-operator/internal/clock"
+	"github.com/fireflycons/ecr-secret-operator/internal/registry"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// Container waiting reason and event reasons for a failed image pull
+const (
+	REASON_ERR_IMAGE_PULL = "ErrImagePull"
+	REASON_FAILED         = "Failed"
+	REASON_BACK_OFF       = "BackOff"
+)
+
+// Index of events by the UID of the object they are about
+const EVENT_INVOLVED_OBJECT_UID_INDEX = "involvedObject.uid"
+
+// Fragments of image pull error messages that mean the registry rejected the credentials
+var authFailureMessages = []string{
+	"401 unauthorized",
+	"403 forbidden",
+	"no basic auth credentials",
+	"authorization token has expired",
+	"authorization failed",
+	"authentication required",
+}
+
+// Gets the image from a kubelet pull failure event message
+var failedImageMessage = regexp.MustCompile(`Failed to pull image "([^"]+)"`)
+
+// PullFailureReconciler watches for pods failing to pull ECR images because the registry rejected
+// the credentials, and requests a refresh of the ECRSecrets whose secrets the pods use.
+type PullFailureReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Minimum time between refreshes of any one ECRSecret
+	MinInterval time.Duration
+	clock.Clock
+}
+
+// An image that failed to pull, and when, if known
+type pullFailure struct {
+	image string
+	at    time.Time
+}
+
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=get;list;watch
+
+// Reconcile is called with a pod that has, or has had, an image pull rejected by the registry.
+// The refresh is requested by setting the refresh annotation on the ECRSecret.
+func (r *PullFailureReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	log.V(5).Info("Begin reconciler")
+
+	pod := corev1.Pod{}
+
+	if err := r.Get(ctx, req.NamespacedName, &pod); err != nil {
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	failures := getStatusPullFailures(&pod)
+
+	events := corev1.EventList{}
+
+	if err := r.List(ctx, &events, client.InNamespace(pod.Namespace), client.MatchingFields{EVENT_INVOLVED_OBJECT_UID_INDEX: string(pod.UID)}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	for i := range events.Items {
+		if failure, ok := getEventPullFailure(&events.Items[i]); ok {
+			failures = append(failures, failure)
+		}
+	}
+
+	if len(failures) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	pullSecrets := map[string]bool{}
+
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		pullSecrets[ref.Name] = true
+	}
+
+	ecrSecrets := secretsv1.ECRSecretList{}
+
+	if err := r.List(ctx, &ecrSecrets, client.InNamespace(pod.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	for i := range ecrSecrets.Items {
+
+		ecrSecret := &ecrSecrets.Items[i]
+
+		if !pullSecrets[ecrSecret.KubeSecretName()] || !ecrSecret.DeletionTimestamp.IsZero() || ecrSecret.Spec.Suspend {
+			continue
+		}
+
+		for _, failure := range failures {
+
+			host := registry.FromImage(failure.image)
+
+			if !coversRegistry(ecrSecret, host) || !r.shouldRefresh(ecrSecret, failure) {
+				continue
+			}
+
+			log.Info("Image pull rejected by registry. Requesting refresh", "Namespace", pod.Namespace, "Pod", pod.Name, "Image", failure.image, "ECRSecret", ecrSecret.Name)
+
+			if err := r.requestRefresh(ctx, ecrSecret); err != nil {
+				if apierrs.IsConflict(err) {
+					// Another pod may have requested the refresh. We'll see it when we try again
+					return ctrl.Result{Requeue: true}, nil
+				}
+
+				return ctrl.Result{}, err
+			}
+
+			break
+		}
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// Determine whether the failure warrants a refresh of the ECRSecret. Failures from before the
+// secret was last updated are ignored, and refreshes are no more frequent than MinInterval.
+// The time of the last request is that in the refresh annotation, so is shared by all workers.
+func (r *PullFailureReconciler) shouldRefresh(ecrSecret *secretsv1.ECRSecret, failure pullFailure) bool {
+
+	now := r.Now()
+	lastUpdated := ecrSecret.Status.LastUpdated
+
+	if lastUpdated != nil {
+		if !failure.at.IsZero() && failure.at.Before(lastUpdated.Time) {
+			return false
+		}
+
+		if now.Sub(lastUpdated.Time) < r.MinInterval {
+			return false
+		}
+	}
+
+	if last, err := time.Parse(time.RFC3339, ecrSecret.Annotations[secretsv1.AnnotationRefreshRequestedAt]); err == nil && now.Sub(last) < r.MinInterval {
+		return false
+	}
+
+	return true
+}
+
+// Set the refresh annotation, which the ECRSecret reconciler acts on
+func (r *PullFailureReconciler) requestRefresh(ctx context.Context, ecrSecret *secretsv1.ECRSecret) error {
+
+	if ecrSecret.Annotations == nil {
+		ecrSecret.Annotations = map[string]string{}
+	}
+
+	ecrSecret.Annotations[secretsv1.AnnotationRefreshRequestedAt] = r.Now().Format(time.RFC3339)
+
+	return r.Update(ctx, ecrSecret)
+}
+
+// Determine whether an image pull error message means the registry rejected the credentials
+func isAuthFailure(message string) bool {
+
+	message = strings.ToLower(message)
+
+	for _, fragment := range authFailureMessages {
+		if strings.Contains(message, fragment) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the images of containers waiting on a pull the registry rejected.
+// Once the pod is in back off the waiting message no longer gives the cause,
+// so those are found from the events.
+func getStatusPullFailures(pod *corev1.Pod) []pullFailure {
+
+	var failures []pullFailure
+
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			if waiting := status.State.Waiting; waiting != nil && waiting.Reason == REASON_ERR_IMAGE_PULL && isAuthFailure(waiting.Message) {
+				failures = append(failures, pullFailure{image: status.Image})
+			}
+		}
+	}
+
+	return failures
+}
+
+// Get the image of a kubelet event for a pull the registry rejected
+func getEventPullFailure(event *corev1.Event) (pullFailure, bool) {
+
+	if event.Reason != REASON_FAILED || event.InvolvedObject.Kind != "Pod" || !isAuthFailure(event.Message) {
+		return pullFailure{}, false
+	}
+
+	match := failedImageMessage.FindStringSubmatch(event.Message)
+
+	if match == nil {
+		return pullFailure{}, false
+	}
+
+	failure := pullFailure{image: match[1]}
+
+	switch {
+	case !event.LastTimestamp.IsZero():
+		failure.at = event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		failure.at = event.EventTime.Time
+	default:
+		failure.at = event.CreationTimestamp.Time
+	}
+
+	return failure, true
+}
+
+// Only pods with a rejected pull need reconciling
+func hasStatusPullFailure(obj client.Object) bool {
+
+	pod, ok := obj.(*corev1.Pod)
+
+	return ok && len(getStatusPullFailures(pod)) > 0
+}
+
+// Only events that may be about a failed pull need mapping
+func isPullFailureEventReason(obj client.Object) bool {
+
+	event, ok := obj.(*corev1.Event)
+
+	if !ok {
+		return false
+	}
+
+	switch event.Reason {
+	case REASON_FAILED, REASON_ERR_IMAGE_PULL, REASON_BACK_OFF:
+		return true
+	}
+
+	return false
+}
+
+// Index events by the UID of the object they are about
+func indexEventInvolvedObjectUid(obj client.Object) []string {
+
+	event, ok := obj.(*corev1.Event)
+
+	if !ok || event.InvolvedObject.UID == "" {
+		return nil
+	}
+
+	return []string{string(event.InvolvedObject.UID)}
+}
+
+// Map a rejected pull event to the pod it is about
+func mapPullFailureEvent(obj client.Object) []reconcile.Request {
+
+	event, ok := obj.(*corev1.Event)
+
+	if !ok {
+		return nil
+	}
+
+	if _, failed := getEventPullFailure(event); !failed {
+		return nil
+	}
+
+	return []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Name: event.InvolvedObject.Name, Namespace: event.InvolvedObject.Namespace}},
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PullFailureReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	if r.Clock == nil {
+		r.Clock = clock.RealClock{}
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Event{}, EVENT_INVOLVED_OBJECT_UID_INDEX, indexEventInvolvedObjectUid); err != nil {
+		return err
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("pullfailure").
+		For(&corev1.Pod{}, builder.WithPredicates(predicate.NewPredicateFuncs(hasStatusPullFailure))).
+		Watches(
+			&source.Kind{Type: &corev1.Event{}},
+			handler.EnqueueRequestsFromMapFunc(mapPullFailureEvent),
+			builder.WithPredicates(predicate.NewPredicateFuncs(isPullFailureEventReason)),
+		).
+		Complete(r)
+}
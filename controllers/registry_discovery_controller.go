@@ -0,0 +1,427 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	"github.com/fireflycons/ecr-secret-operator/internal/clock"
+	"github.com/fireflycons/ecr-secret-operator/internal/config"
+	"github.com/fireflycons/ecr-secret-operator/internal/registry"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// Namespaces opt in to registry discovery with this label set to "enabled"
+const (
+	LABEL_DISCOVER_REGISTRIES = "secrets.fireflycons.io/discover-registries"
+	DISCOVERY_ENABLED         = "enabled"
+)
+
+// Annotation on a discovered ECRSecret recording when workloads stopped using its registry
+const ANNOTATION_UNUSED_SINCE = "secrets.fireflycons.io/unused-since"
+
+// RegistryDiscoveryReconciler creates an ECRSecret for each ECR registry used by the
+// workloads in an opted in namespace, and removes it again once the registry is no longer used.
+type RegistryDiscoveryReconciler struct {
+	client.Client
+	Scheme     *runtime.Scheme
+	ConfigFile string
+	// How long a discovered ECRSecret is kept after no workload uses its registry
+	GracePeriod time.Duration
+	clock.Clock
+}
+
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets,verbs=get;list;watch
+
+// Reconcile is called with the name of a namespace. It compares the ECR registries used by the
+// namespace's pods, deployments and statefulsets with the ECRSecrets in the namespace.
+func (r *RegistryDiscoveryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	log.V(5).Info("Begin reconciler")
+
+	namespace := corev1.Namespace{}
+
+	if err := r.Get(ctx, req.NamespacedName, &namespace); err != nil {
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	// A namespace that opts out has no registries in use, so its discovered ECRSecrets age out
+	inUse := map[string]bool{}
+
+	if namespace.Labels[LABEL_DISCOVER_REGISTRIES] == DISCOVERY_ENABLED && namespace.Status.Phase != corev1.NamespaceTerminating {
+
+		var err error
+
+		if inUse, err = r.getRegistriesInUse(ctx, namespace.Name); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	ecrSecrets := secretsv1.ECRSecretList{}
+
+	if err := r.List(ctx, &ecrSecrets, client.InNamespace(namespace.Name)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.createECRSecrets(ctx, namespace.Name, inUse, ecrSecrets.Items); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return r.removeUnusedECRSecrets(ctx, inUse, ecrSecrets.Items)
+}
+
+// Get the ECR registry hosts used by the workloads in the namespace
+func (r *RegistryDiscoveryReconciler) getRegistriesInUse(ctx context.Context, namespace string) (map[string]bool, error) {
+
+	var specs []*corev1.PodSpec
+
+	pods := corev1.PodList{}
+
+	if err := r.List(ctx, &pods, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+
+	for i := range pods.Items {
+		// Finished pods no longer need to pull anything
+		if phase := pods.Items[i].Status.Phase; phase != corev1.PodSucceeded && phase != corev1.PodFailed {
+			specs = append(specs, &pods.Items[i].Spec)
+		}
+	}
+
+	deployments := appsv1.DeploymentList{}
+
+	if err := r.List(ctx, &deployments, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+
+	for i := range deployments.Items {
+		specs = append(specs, &deployments.Items[i].Spec.Template.Spec)
+	}
+
+	statefulSets := appsv1.StatefulSetList{}
+
+	if err := r.List(ctx, &statefulSets, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+
+	for i := range statefulSets.Items {
+		specs = append(specs, &statefulSets.Items[i].Spec.Template.Spec)
+	}
+
+	return getECRRegistries(specs), nil
+}
+
+// Get the ECR registry hosts of the images in the pod specs
+func getECRRegistries(specs []*corev1.PodSpec) map[string]bool {
+
+	hosts := map[string]bool{}
+
+	for _, spec := range specs {
+		for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+			for _, container := range containers {
+
+				host := registry.FromImage(container.Image)
+
+				if _, _, ok := registry.ParseECR(host); ok {
+					hosts[host] = true
+				}
+			}
+		}
+	}
+
+	return hosts
+}
+
+// Determine whether the ECRSecret provides auth for the registry host
+func coversRegistry(ecrSecret *secretsv1.ECRSecret, host string) bool {
+
+	for _, r := range ecrSecret.Registries() {
+		if registry.Host(r) == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Name of the ECRSecret created for a discovered registry
+func getDiscoveredName(host string) string {
+
+	accountId, region, _ := registry.ParseECR(host)
+
+	return fmt.Sprintf("ecr-%s-%s", accountId, region)
+}
+
+// Create an ECRSecret for each registry in use that no ECRSecret in the namespace already covers,
+// where the registry's account has credentials configured
+func (r *RegistryDiscoveryReconciler) createECRSecrets(ctx context.Context, namespace string, inUse map[string]bool, ecrSecrets []secretsv1.ECRSecret) error {
+
+	log := log.FromContext(ctx)
+
+	var accounts map[string]bool
+
+	for host := range inUse {
+
+		covered := false
+
+		for i := range ecrSecrets {
+			if coversRegistry(&ecrSecrets[i], host) {
+				covered = true
+				break
+			}
+		}
+
+		if covered {
+			continue
+		}
+
+		if accounts == nil {
+
+			var err error
+
+			if accounts, err = r.getConfiguredAccounts(); err != nil {
+				return err
+			}
+		}
+
+		accountId, _, _ := registry.ParseECR(host)
+
+		if !accounts[accountId] {
+			log.V(5).Info("No credentials configured for discovered registry", "Namespace", namespace, "Registry", host)
+			continue
+		}
+
+		ecrSecret := &secretsv1.ECRSecret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      getDiscoveredName(host),
+				Namespace: namespace,
+				Labels:    map[string]string{secretsv1.LabelDiscovered: "true"},
+			},
+			Spec: secretsv1.ECRSecretSpec{
+				Registry: host,
+			},
+		}
+
+		log.Info("Creating ECRSecret for discovered registry", "Namespace", namespace, "ECRSecret", ecrSecret.Name, "Registry", host)
+
+		if err := r.Create(ctx, ecrSecret); err != nil {
+			if apierrs.IsAlreadyExists(err) {
+				log.Info("Not creating ECRSecret for discovered registry. An ECRSecret of the same name exists", "Namespace", namespace, "ECRSecret", ecrSecret.Name)
+				continue
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Load the accounts that have credentials in the config file
+func (r *RegistryDiscoveryReconciler) getConfiguredAccounts() (map[string]bool, error) {
+
+	configStream, err := os.Open(r.ConfigFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer configStream.Close()
+
+	ids, err := config.LoadAccounts(configStream)
+
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := map[string]bool{}
+
+	for _, id := range ids {
+		accounts[id] = true
+	}
+
+	return accounts, nil
+}
+
+// Mark discovered ECRSecrets whose registry is not in use, and delete those that have been
+// unused for the grace period. Requeues for the earliest one still to expire.
+func (r *RegistryDiscoveryReconciler) removeUnusedECRSecrets(ctx context.Context, inUse map[string]bool, ecrSecrets []secretsv1.ECRSecret) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	result := ctrl.Result{}
+	now := r.Now()
+
+	for i := range ecrSecrets {
+
+		ecrSecret := &ecrSecrets[i]
+
+		if ecrSecret.Labels[secretsv1.LabelDiscovered] != "true" || !ecrSecret.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		used := false
+
+		for host := range inUse {
+			if coversRegistry(ecrSecret, host) {
+				used = true
+				break
+			}
+		}
+
+		unusedSince, marked := ecrSecret.Annotations[ANNOTATION_UNUSED_SINCE]
+
+		if used {
+			if marked {
+				// Back in use before the grace period expired
+				delete(ecrSecret.Annotations, ANNOTATION_UNUSED_SINCE)
+
+				if err := r.Update(ctx, ecrSecret); err != nil {
+					return result, err
+				}
+			}
+
+			continue
+		}
+
+		if !marked {
+			log.Info("Registry of discovered ECRSecret no longer in use", "Namespace", ecrSecret.Namespace, "ECRSecret", ecrSecret.Name, "GracePeriod", r.GracePeriod)
+
+			if ecrSecret.Annotations == nil {
+				ecrSecret.Annotations = map[string]string{}
+			}
+
+			ecrSecret.Annotations[ANNOTATION_UNUSED_SINCE] = now.Format(time.RFC3339)
+
+			if err := r.Update(ctx, ecrSecret); err != nil {
+				return result, err
+			}
+
+			result = requeueSooner(result, r.GracePeriod)
+			continue
+		}
+
+		since, err := time.Parse(time.RFC3339, unusedSince)
+
+		// An annotation we can't read is treated as expired
+		if remaining := since.Add(r.GracePeriod).Sub(now); err == nil && remaining > 0 {
+			result = requeueSooner(result, remaining)
+			continue
+		}
+
+		log.Info("Deleting unused discovered ECRSecret", "Namespace", ecrSecret.Namespace, "ECRSecret", ecrSecret.Name)
+
+		if err := r.Delete(ctx, ecrSecret); client.IgnoreNotFound(err) != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+func requeueSooner(result ctrl.Result, after time.Duration) ctrl.Result {
+
+	if result.RequeueAfter == 0 || after < result.RequeueAfter {
+		result.RequeueAfter = after
+	}
+
+	return result
+}
+
+// Determine whether the object is in a namespace that has opted in to discovery.
+// Workloads elsewhere are of no interest, so are filtered out of the watches.
+func (r *RegistryDiscoveryReconciler) isInDiscoveryNamespace(obj client.Object) bool {
+
+	namespace := corev1.Namespace{}
+
+	if err := r.Get(context.Background(), types.NamespacedName{Name: obj.GetNamespace()}, &namespace); err != nil {
+		return false
+	}
+
+	return namespace.Labels[LABEL_DISCOVER_REGISTRIES] == DISCOVERY_ENABLED
+}
+
+// Map a workload event to its namespace, if the namespace has opted in to discovery
+func (r *RegistryDiscoveryReconciler) mapToNamespace(obj client.Object) []reconcile.Request {
+
+	if !r.isInDiscoveryNamespace(obj) {
+		return nil
+	}
+
+	return namespaceRequest(obj)
+}
+
+// Map a discovered ECRSecret event to its namespace, so that it is recreated if deleted while still in use.
+// Namespaces that have opted out are still reconciled, so their discovered ECRSecrets age out.
+func mapDiscoveredECRSecret(obj client.Object) []reconcile.Request {
+
+	if obj.GetLabels()[secretsv1.LabelDiscovered] != "true" {
+		return nil
+	}
+
+	return namespaceRequest(obj)
+}
+
+// A request to reconcile the object's namespace
+func namespaceRequest(obj client.Object) []reconcile.Request {
+	return []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Name: obj.GetNamespace()}},
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *RegistryDiscoveryReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	if r.Clock == nil {
+		r.Clock = clock.RealClock{}
+	}
+
+	inDiscoveryNamespace := builder.WithPredicates(predicate.NewPredicateFuncs(r.isInDiscoveryNamespace))
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("registrydiscovery").
+		For(&corev1.Namespace{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, handler.EnqueueRequestsFromMapFunc(r.mapToNamespace), inDiscoveryNamespace).
+		Watches(&source.Kind{Type: &appsv1.Deployment{}}, handler.EnqueueRequestsFromMapFunc(r.mapToNamespace), inDiscoveryNamespace).
+		Watches(&source.Kind{Type: &appsv1.StatefulSet{}}, handler.EnqueueRequestsFromMapFunc(r.mapToNamespace), inDiscoveryNamespace).
+		Watches(&source.Kind{Type: &secretsv1.ECRSecret{}}, handler.EnqueueRequestsFromMapFunc(mapDiscoveredECRSecret)).
+		Complete(r)
+}
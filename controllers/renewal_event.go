@@ -23,11 +23,12 @@ import (
 	"sync"
 	"time"
 
-	"github.com/fireflycons/ecr-secret-operator/api/v1beta1"
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
 	"github.com/fireflycons/ecr-secret-operator/internal/clock"
 	"github.com/fireflycons/ecr-secret-operator/internal/ksecret"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
@@ -45,7 +46,7 @@ type RenewalEvent struct {
 	clock.Clock
 }
 
-func CreateRenewalEvent(client client.Client, secrets chan<- event.GenericEvent) RenewalEvent {
+func CreateRenewalEvent(client client.Client, secrets chan<- event.GenericEvent, maxAge time.Duration) RenewalEvent {
 	log := ctrl.Log.
 		WithName("source").
 		WithName(reflect.TypeOf(RenewalEvent{}).Name())
@@ -54,6 +55,7 @@ func CreateRenewalEvent(client client.Client, secrets chan<- event.GenericEvent)
 		log:     log,
 		client:  client,
 		lock:    sync.RWMutex{},
+		maxAge:  maxAge,
 		secrets: secrets,
 		Clock:   clock.RealClock{},
 	}
@@ -123,21 +125,41 @@ func (t *RenewalEvent) pollSecrets() error {
 
 			secretsLog := namespaceLog.WithValues("secret", secret.Name)
 
-			if secret.Type != "kubernetes.io/dockerconfigjson" {
-				secretsLog.V(5).Info("Not a docker secret")
+			if _, ok := secret.Annotations[ksecret.ANNOTATION_EXPIRES]; !ok {
+				secretsLog.V(5).Info("Not an ECR secret")
 				continue
 			}
 
-			if ksecret.IsExpired(&secret, t.maxAge, t.Clock) {
-				secretsLog.V(5).Info("Secret needs renewal")
-				owner := secret.OwnerReferences[0]
-				ecrSecret := v1beta1.ECRSecret{}
-				err := t.client.Get(t.ctx, types.NamespacedName{Name: owner.Name, Namespace: secret.Namespace}, &ecrSecret)
+			var ownerName string
 
-				if err != nil {
-					secretsLog.Error(err, "Cannot get owning secret", "ECRSecret", owner.Name)
-					continue
-				}
+			if owner := metav1.GetControllerOf(&secret); owner != nil && owner.Kind == "ECRSecret" {
+				ownerName = owner.Name
+			} else if mergedBy, ok := secret.Annotations[ksecret.ANNOTATION_MERGED_BY]; ok {
+				// User-managed secret that an ECRSecret has merged its auth into
+				ownerName = mergedBy
+			} else {
+				secretsLog.V(5).Info("Secret not owned by an ECRSecret")
+				continue
+			}
+
+			ecrSecret := secretsv1.ECRSecret{}
+			err := t.client.Get(t.ctx, types.NamespacedName{Name: ownerName, Namespace: secret.Namespace}, &ecrSecret)
+
+			if err != nil {
+				secretsLog.Error(err, "Cannot get owning secret", "ECRSecret", ownerName)
+				continue
+			}
+
+			if ecrSecret.Spec.Suspend {
+				secretsLog.V(5).Info("Rotation is suspended", "ECRSecret", ownerName)
+				continue
+			}
+
+			// Errors in the rotation window are reported by the reconciler.
+			maxAge, _ := getRotationAge(&ecrSecret, &secret, t.maxAge)
+
+			if ksecret.IsExpired(&secret, maxAge, t.Clock) {
+				secretsLog.V(5).Info("Secret needs renewal")
 
 				evt := event.GenericEvent{
 					Object: &ecrSecret,
@@ -18,6 +18,7 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -28,18 +29,23 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
-	secretsv1beta1 "github.com/fireflycons/ecr-secret-operator/api/v1beta1"
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
 	"github.com/fireflycons/ecr-secret-operator/internal/aws"
 	"github.com/fireflycons/ecr-secret-operator/internal/clock"
 	"github.com/fireflycons/ecr-secret-operator/internal/ksecret"
@@ -101,7 +107,7 @@ var _ = BeforeSuite(func(ctx SpecContext) {
 
 	err = scheme.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
-	err = secretsv1beta1.AddToScheme(scheme.Scheme)
+	err = secretsv1.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
 
 	//+kubebuilder:scaffold:scheme
@@ -127,6 +133,34 @@ var _ = BeforeSuite(func(ctx SpecContext) {
 	}).SetupWithManager((k8sManager))
 	Expect(err).ToNot(HaveOccurred())
 
+	err = (&ClusterECRSecretReconciler{
+		Client: k8sManager.GetClient(),
+		Scheme: k8sManager.GetScheme(),
+	}).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = (&PullFailureReconciler{
+		Client:      k8sManager.GetClient(),
+		Scheme:      k8sManager.GetScheme(),
+		MinInterval: time.Second,
+	}).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = (&UsageReconciler{
+		Client:      k8sManager.GetClient(),
+		Scheme:      k8sManager.GetScheme(),
+		UnusedAfter: time.Second * 3,
+	}).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = (&RegistryDiscoveryReconciler{
+		Client:      k8sManager.GetClient(),
+		Scheme:      k8sManager.GetScheme(),
+		ConfigFile:  filepath.Join("..", "config.toml"),
+		GracePeriod: time.Second * 2,
+	}).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
 	go func() {
 		err = k8sManager.Start(setupSignalHandler())
 		Expect(err).ToNot(HaveOccurred())
@@ -137,6 +171,31 @@ var _ = BeforeSuite(func(ctx SpecContext) {
 
 })
 
+// Build an ECRSecret for the test registry whose secret has the same name, changed by the mutators
+func newECRSecret(name, namespace string, mutate ...func(*secretsv1.ECRSecret)) *secretsv1.ECRSecret {
+
+	ecrSecret := &secretsv1.ECRSecret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: secretsv1.GroupVersion.String(),
+			Kind:       "ECRSecret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: secretsv1.ECRSecretSpec{
+			Registry:   aws.TEST_REGISTRY,
+			SecretName: name,
+		},
+	}
+
+	for _, m := range mutate {
+		m(ecrSecret)
+	}
+
+	return ecrSecret
+}
+
 var secretName = "test-secret"
 var secretNamespace = "default"
 var secretLookupKey = types.NamespacedName{Name: secretName, Namespace: secretNamespace}
@@ -147,26 +206,11 @@ var _ = Describe("ECR Secret Lifecycle", func() {
 		ctx := context.Background()
 
 		By("By creating a new ECRSecret")
-		spec := secretsv1beta1.ECRSecretSpec{
-			Registry:   aws.TEST_REGISTRY,
-			SecretName: secretName,
-		}
-
-		ecrsecret := secretsv1beta1.ECRSecret{
-			TypeMeta: metav1.TypeMeta{
-				APIVersion: "ecrsecrets.secrets.fireflycons.io/v1beta1",
-				Kind:       "ECRSecret",
-			},
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      secretName,
-				Namespace: secretNamespace,
-			},
-			Spec: spec,
-		}
+		ecrsecret := newECRSecret(secretName, secretNamespace)
 
-		Expect(k8sClient.Create(ctx, &ecrsecret)).Should(Succeed())
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
 
-		createdEcrSecret := &secretsv1beta1.ECRSecret{}
+		createdEcrSecret := &secretsv1.ECRSecret{}
 
 		Eventually(func() bool {
 			err := k8sClient.Get(ctx, secretLookupKey, createdEcrSecret)
@@ -188,13 +232,14 @@ var _ = Describe("ECR Secret Lifecycle", func() {
 		Expect(createdSecret.Name).To(Equal(secretName))
 		Expect(createdSecret.Annotations[ksecret.ANNOTATION_EXPIRES]).To(Equal(aws.TEST_EXPIRY))
 		Expect(createdSecret.Annotations[ksecret.ANNOTATION_LIFETIME]).To(Equal(aws.VALID_LIFETIME))
+		Expect(createdSecret.Labels).To(HaveKeyWithValue(ksecret.LABEL_MANAGED, ksecret.MANAGED))
 
 		By("Deleting the ECR secret")
 
 		Eventually(func() bool {
 			// Force a foregrround delete of dependent ojbect so as not to have to wait for garbage collection
 			x := metav1.DeletePropagationForeground
-			err := k8sClient.Delete(ctx, &ecrsecret, &client.DeleteOptions{PropagationPolicy: &x})
+			err := k8sClient.Delete(ctx, ecrsecret, &client.DeleteOptions{PropagationPolicy: &x})
 
 			return err == nil
 		}, time.Second*5, time.Second).Should(BeTrue())
@@ -211,58 +256,1331 @@ var _ = Describe("ECR Secret Lifecycle", func() {
 	})
 })
 
-var _ = Describe("CRD errors", func() {
-	invalidRegistry := "docker.io"
-	badSecretName := "should-fail-secret"
+var _ = Describe("Deletion Policy", func() {
+	It("Should retain secret when deletion policy is Retain", func() {
 
-	It("Should fail if registry does not match pattern for ECR", func() {
+		ctx := context.Background()
+		retainedName := "retained-secret"
+		retainedLookupKey := types.NamespacedName{Name: retainedName, Namespace: secretNamespace}
+
+		By("By creating a new ECRSecret with Retain policy")
+		ecrsecret := newECRSecret(retainedName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.DeletionPolicy = secretsv1.DeletionPolicyRetain
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		By("A kube secret should be created")
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, retainedLookupKey, &v1.Secret{})
+			return err == nil
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		By("Finalizer should be added")
+
+		Eventually(func() bool {
+			createdEcrSecret := &secretsv1.ECRSecret{}
+			err := k8sClient.Get(ctx, retainedLookupKey, createdEcrSecret)
+			return err == nil && controllerutil.ContainsFinalizer(createdEcrSecret, FINALIZER_NAME)
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		By("Deleting the ECR secret")
+
+		Expect(k8sClient.Delete(ctx, ecrsecret)).Should(Succeed())
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, retainedLookupKey, &secretsv1.ECRSecret{})
+			return apierrs.IsNotFound(err)
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		By("Kube secret should be orphaned")
+
+		retainedSecret := &v1.Secret{}
+		Expect(k8sClient.Get(ctx, retainedLookupKey, retainedSecret)).Should(Succeed())
+		Expect(retainedSecret.OwnerReferences).To(BeEmpty())
+		Expect(retainedSecret.Annotations).To(HaveKey(ksecret.ANNOTATION_ORPHANED))
+		Expect(retainedSecret.Labels).NotTo(HaveKey(ksecret.LABEL_MANAGED))
+	})
+})
+
+var _ = Describe("Suspend", func() {
+	It("Should not create secret while suspended", func() {
+
+		ctx := context.Background()
+		suspendedName := "suspended-secret"
+		suspendedLookupKey := types.NamespacedName{Name: suspendedName, Namespace: secretNamespace}
+
+		By("By creating a new suspended ECRSecret")
+		ecrsecret := newECRSecret(suspendedName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.Suspend = true
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		By("Suspended condition should be set")
+
+		Eventually(func() bool {
+			createdEcrSecret := &secretsv1.ECRSecret{}
+			err := k8sClient.Get(ctx, suspendedLookupKey, createdEcrSecret)
+			return err == nil && meta.IsStatusConditionTrue(createdEcrSecret.Status.Conditions, secretsv1.ConditionSuspended)
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		By("A kube secret should not be created")
+
+		Consistently(func() bool {
+			err := k8sClient.Get(ctx, suspendedLookupKey, &v1.Secret{})
+			return apierrs.IsNotFound(err)
+		}, time.Second*3, time.Second).Should(BeTrue())
+
+		By("Resuming the ECRSecret")
+
+		Eventually(func() error {
+			resumed := &secretsv1.ECRSecret{}
+
+			if err := k8sClient.Get(ctx, suspendedLookupKey, resumed); err != nil {
+				return err
+			}
+
+			resumed.Spec.Suspend = false
+			return k8sClient.Update(ctx, resumed)
+		}, time.Second*5, time.Second).Should(Succeed())
+
+		By("A kube secret should now be created")
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, suspendedLookupKey, &v1.Secret{})
+			return err == nil
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		Eventually(func() bool {
+			resumed := &secretsv1.ECRSecret{}
+			err := k8sClient.Get(ctx, suspendedLookupKey, resumed)
+			return err == nil && meta.IsStatusConditionFalse(resumed.Status.Conditions, secretsv1.ConditionSuspended)
+		}, time.Second*5, time.Second).Should(BeTrue())
+	})
+})
+
+var _ = Describe("Refresh Request", func() {
+	It("Should refresh secret when annotation changes", func() {
 
 		ctx := context.Background()
+		refreshName := "refresh-secret"
+		refreshLookupKey := types.NamespacedName{Name: refreshName, Namespace: secretNamespace}
+		requestedAt := "2023-01-01T06:00:00Z"
 
 		By("By creating a new ECRSecret")
-		spec := secretsv1beta1.ECRSecretSpec{
-			Registry:   invalidRegistry,
-			SecretName: badSecretName,
+		ecrsecret := newECRSecret(refreshName, secretNamespace)
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, refreshLookupKey, &v1.Secret{})
+			return err == nil
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		By("Requesting a refresh")
+
+		Eventually(func() error {
+			refreshed := &secretsv1.ECRSecret{}
+
+			if err := k8sClient.Get(ctx, refreshLookupKey, refreshed); err != nil {
+				return err
+			}
+
+			refreshed.Annotations = map[string]string{secretsv1.AnnotationRefreshRequestedAt: requestedAt}
+			return k8sClient.Update(ctx, refreshed)
+		}, time.Second*5, time.Second).Should(Succeed())
+
+		By("Refresh request should be recorded as handled")
+
+		Eventually(func() string {
+			refreshed := &secretsv1.ECRSecret{}
+			_ = k8sClient.Get(ctx, refreshLookupKey, refreshed)
+			return refreshed.Status.LastHandledRefreshRequest
+		}, time.Second*5, time.Second).Should(Equal(requestedAt))
+	})
+})
+
+var _ = Describe("Secret Template", func() {
+	It("Should apply template and keep foreign annotations across rotation", func() {
+
+		ctx := context.Background()
+		templateName := "template-secret"
+		templateLookupKey := types.NamespacedName{Name: templateName, Namespace: secretNamespace}
+
+		By("By creating a new ECRSecret with a secret template")
+		ecrsecret := newECRSecret(templateName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.SecretTemplate = &secretsv1.SecretTemplate{
+				Metadata: secretsv1.SecretTemplateMetadata{
+					Labels:      map[string]string{"velero.io/exclude-from-backup": "true"},
+					Annotations: map[string]string{"reflector.v1.k8s.emberstack.com/reflection-allowed": "true"},
+				},
+			}
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		createdSecret := &v1.Secret{}
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, templateLookupKey, createdSecret)
+			return err == nil
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		Expect(createdSecret.Labels).To(HaveKeyWithValue("velero.io/exclude-from-backup", "true"))
+		Expect(createdSecret.Annotations).To(HaveKeyWithValue("reflector.v1.k8s.emberstack.com/reflection-allowed", "true"))
+
+		By("Adding a foreign annotation to the kube secret")
+
+		Eventually(func() error {
+			if err := k8sClient.Get(ctx, templateLookupKey, createdSecret); err != nil {
+				return err
+			}
+
+			createdSecret.Annotations["example.com/owner"] = "someone"
+			return k8sClient.Update(ctx, createdSecret)
+		}, time.Second*5, time.Second).Should(Succeed())
+
+		By("Requesting a refresh")
+
+		Eventually(func() error {
+			refreshed := &secretsv1.ECRSecret{}
+
+			if err := k8sClient.Get(ctx, templateLookupKey, refreshed); err != nil {
+				return err
+			}
+
+			refreshed.Annotations = map[string]string{secretsv1.AnnotationRefreshRequestedAt: "now"}
+			return k8sClient.Update(ctx, refreshed)
+		}, time.Second*5, time.Second).Should(Succeed())
+
+		Eventually(func() string {
+			refreshed := &secretsv1.ECRSecret{}
+			_ = k8sClient.Get(ctx, templateLookupKey, refreshed)
+			return refreshed.Status.LastHandledRefreshRequest
+		}, time.Second*5, time.Second).Should(Equal("now"))
+
+		By("Template and foreign annotations should survive")
+
+		Expect(k8sClient.Get(ctx, templateLookupKey, createdSecret)).Should(Succeed())
+		Expect(createdSecret.Labels).To(HaveKeyWithValue("velero.io/exclude-from-backup", "true"))
+		Expect(createdSecret.Annotations).To(HaveKeyWithValue("reflector.v1.k8s.emberstack.com/reflection-allowed", "true"))
+		Expect(createdSecret.Annotations).To(HaveKeyWithValue("example.com/owner", "someone"))
+
+		By("Removing the label from the template")
+
+		Eventually(func() error {
+			updated := &secretsv1.ECRSecret{}
+
+			if err := k8sClient.Get(ctx, templateLookupKey, updated); err != nil {
+				return err
+			}
+
+			updated.Spec.SecretTemplate.Metadata.Labels = nil
+			return k8sClient.Update(ctx, updated)
+		}, time.Second*5, time.Second).Should(Succeed())
+
+		Eventually(func() bool {
+			if err := k8sClient.Get(ctx, templateLookupKey, createdSecret); err != nil {
+				return false
+			}
+			_, ok := createdSecret.Labels["velero.io/exclude-from-backup"]
+			return !ok
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		Expect(createdSecret.Annotations).To(HaveKeyWithValue("reflector.v1.k8s.emberstack.com/reflection-allowed", "true"))
+		Expect(createdSecret.Annotations).To(HaveKeyWithValue("example.com/owner", "someone"))
+	})
+})
+
+var _ = Describe("Opaque Format", func() {
+	It("Should create opaque secret with username and password", func() {
+
+		ctx := context.Background()
+		opaqueName := "opaque-secret"
+		opaqueLookupKey := types.NamespacedName{Name: opaqueName, Namespace: secretNamespace}
+
+		By("By creating a new ECRSecret with Opaque format")
+		ecrsecret := newECRSecret(opaqueName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.Format = secretsv1.SecretFormatOpaque
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		createdSecret := &v1.Secret{}
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, opaqueLookupKey, createdSecret)
+			return err == nil
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		By("Checking created secret properties")
+
+		Expect(createdSecret.Type).To(Equal(v1.SecretTypeOpaque))
+		Expect(createdSecret.Data["username"]).To(Equal([]byte(aws.TEST_USER)))
+		Expect(createdSecret.Data["password"]).To(Equal([]byte(aws.TEST_PASSWORD)))
+		Expect(createdSecret.Data["registry"]).To(Equal([]byte(aws.TEST_REGISTRY)))
+		Expect(createdSecret.Data["expiresAt"]).To(Equal([]byte(aws.TEST_EXPIRY)))
+		Expect(ksecret.IsChanged(createdSecret)).To(BeFalse())
+	})
+})
+
+var _ = Describe("Argo CD Format", func() {
+	It("Should remove the Argo CD label when the format changes", func() {
+
+		ctx := context.Background()
+		argoName := "argocd-secret"
+		argoLookupKey := types.NamespacedName{Name: argoName, Namespace: secretNamespace}
+
+		By("By creating a new ECRSecret with ArgoCD format")
+		ecrsecret := newECRSecret(argoName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.Format = secretsv1.SecretFormatArgoCD
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		createdSecret := &v1.Secret{}
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, argoLookupKey, createdSecret)
+			return err == nil
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		Expect(createdSecret.Labels).To(HaveKeyWithValue(ksecret.LABEL_ARGOCD_SECRET_TYPE, ksecret.ARGOCD_REPOSITORY))
+
+		By("Changing the format to Opaque")
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: argoName, Namespace: secretNamespace}, ecrsecret)).To(Succeed())
+		ecrsecret.Spec.Format = secretsv1.SecretFormatOpaque
+		Expect(k8sClient.Update(ctx, ecrsecret)).To(Succeed())
+
+		Eventually(func() bool {
+			if err := k8sClient.Get(ctx, argoLookupKey, createdSecret); err != nil {
+				return false
+			}
+			_, labelled := createdSecret.Labels[ksecret.LABEL_ARGOCD_SECRET_TYPE]
+			return !labelled && len(createdSecret.Data["registry"]) > 0
+		}, time.Second*5, time.Second).Should(BeTrue())
+	})
+})
+
+var _ = Describe("Dockercfg Secret Type", func() {
+	It("Should create legacy dockercfg secret", func() {
+
+		ctx := context.Background()
+		dockercfgName := "dockercfg-secret"
+		dockercfgLookupKey := types.NamespacedName{Name: dockercfgName, Namespace: secretNamespace}
+
+		By("By creating a new ECRSecret with dockercfg secret type")
+		ecrsecret := newECRSecret(dockercfgName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.SecretType = secretsv1.SecretTypeDockercfg
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		createdSecret := &v1.Secret{}
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, dockercfgLookupKey, createdSecret)
+			return err == nil
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		By("Checking created secret properties")
+
+		Expect(createdSecret.Type).To(Equal(v1.SecretTypeDockercfg))
+		Expect(createdSecret.Data).To(HaveKey(".dockercfg"))
+		Expect(ksecret.IsChanged(createdSecret)).To(BeFalse())
+	})
+})
+
+var _ = Describe("Flux Format", func() {
+	It("Should create secret with keys expected by Flux", func() {
+
+		ctx := context.Background()
+		fluxName := "flux-secret"
+		fluxLookupKey := types.NamespacedName{Name: fluxName, Namespace: secretNamespace}
+
+		By("By creating a new ECRSecret with Flux format")
+		ecrsecret := newECRSecret(fluxName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.Format = secretsv1.SecretFormatFlux
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		createdSecret := &v1.Secret{}
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, fluxLookupKey, createdSecret)
+			return err == nil
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		By("Checking rendered keys")
+
+		Expect(createdSecret.Type).To(Equal(v1.SecretTypeDockerConfigJson))
+		Expect(createdSecret.Data).To(HaveKey(".dockerconfigjson"))
+		Expect(createdSecret.Data["username"]).To(Equal([]byte(aws.TEST_USER)))
+		Expect(createdSecret.Data["password"]).To(Equal([]byte(aws.TEST_PASSWORD)))
+
+		config := map[string]map[string]map[string]string{}
+		Expect(json.Unmarshal(createdSecret.Data[".dockerconfigjson"], &config)).To(Succeed())
+		Expect(config["auths"]).To(HaveKey(aws.TEST_REGISTRY))
+
+		for host := range config["auths"] {
+			Expect(host).NotTo(HavePrefix("https://"))
 		}
 
-		ecrsecret := secretsv1beta1.ECRSecret{
-			TypeMeta: metav1.TypeMeta{
-				APIVersion: "ecrsecrets.secrets.fireflycons.io/v1beta1",
-				Kind:       "ECRSecret",
-			},
+		Expect(ksecret.IsChanged(createdSecret)).To(BeFalse())
+	})
+})
+
+var _ = Describe("Merge", func() {
+	It("Should merge into an existing secret and remove the merge on deletion", func() {
+
+		ctx := context.Background()
+		mergeName := "merge-secret"
+		mergeLookupKey := types.NamespacedName{Name: mergeName, Namespace: secretNamespace}
+		userConfig := `{"auths":{"docker.io":{"auth":"dXNlcjpwYXNz"}}}`
+
+		By("By creating a user-managed docker config secret")
+		userSecret := v1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      badSecretName,
+				Name:      mergeName,
 				Namespace: secretNamespace,
 			},
-			Spec: spec,
+			Type: v1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{".dockerconfigjson": []byte(userConfig)},
 		}
 
-		err := k8sClient.Create(ctx, &ecrsecret)
-		Expect(err).To(HaveOccurred())
+		Expect(k8sClient.Create(ctx, &userSecret)).Should(Succeed())
+
+		By("By creating a new ECRSecret that merges into it")
+		ecrsecret := newECRSecret(mergeName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.Merge = true
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		mergedSecret := &v1.Secret{}
+
+		Eventually(func() bool {
+			if err := k8sClient.Get(ctx, mergeLookupKey, mergedSecret); err != nil {
+				return false
+			}
+			return ksecret.IsMerged(mergedSecret)
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		By("Checking both auths are present and the secret is not owned")
+
+		config := map[string]map[string]map[string]string{}
+		Expect(json.Unmarshal(mergedSecret.Data[".dockerconfigjson"], &config)).To(Succeed())
+		Expect(config["auths"]).To(HaveKey("docker.io"))
+		Expect(config["auths"]).To(HaveKey(aws.TEST_REGISTRY))
+		Expect(mergedSecret.OwnerReferences).To(BeEmpty())
+		Expect(mergedSecret.Annotations).To(HaveKeyWithValue(ksecret.ANNOTATION_MERGED_BY, mergeName))
+
+		By("Deleting the ECRSecret")
+		Expect(k8sClient.Delete(ctx, ecrsecret)).Should(Succeed())
+
+		Eventually(func() bool {
+			if err := k8sClient.Get(ctx, mergeLookupKey, mergedSecret); err != nil {
+				return false
+			}
+			return !ksecret.IsMerged(mergedSecret)
+		}, time.Second*5, time.Second).Should(BeTrue())
 
+		config = map[string]map[string]map[string]string{}
+		Expect(json.Unmarshal(mergedSecret.Data[".dockerconfigjson"], &config)).To(Succeed())
+		Expect(config["auths"]).To(HaveLen(1))
+		Expect(config["auths"]).To(HaveKey("docker.io"))
+	})
+
+	It("Should not merge into a secret owned by another ECRSecret", func() {
+
+		ctx := context.Background()
+		ownedName := "merge-owned"
+
+		By("By creating an ECRSecret that generates a secret")
+		owner := newECRSecret(ownedName, secretNamespace)
+
+		Expect(k8sClient.Create(ctx, owner)).Should(Succeed())
+
+		By("By creating a second ECRSecret that tries to merge into it")
+		merger := newECRSecret(ownedName+"-merger", secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.SecretName = ownedName
+			e.Spec.Merge = true
+		})
+
+		Expect(k8sClient.Create(ctx, merger)).Should(Succeed())
+
+		Eventually(func() string {
+			got := secretsv1.ECRSecret{}
+			if err := k8sClient.Get(ctx, types.NamespacedName{Name: merger.Name, Namespace: secretNamespace}, &got); err != nil {
+				return ""
+			}
+			if cond := meta.FindStatusCondition(got.Status.Conditions, secretsv1.ConditionMerged); cond != nil {
+				return cond.Reason
+			}
+			return ""
+		}, time.Second*5, time.Second).Should(Equal(MERGE_REASON_OWNED))
+	})
+
+	It("Should leave alone a secret it does not manage and release the merge when merge is turned off", func() {
+
+		ctx := context.Background()
+		unmergeName := "merge-turned-off"
+		unmergeLookupKey := types.NamespacedName{Name: unmergeName, Namespace: secretNamespace}
+		userConfig := `{"auths":{"docker.io":{"auth":"dXNlcjpwYXNz"}}}`
+
+		By("By creating a user-managed docker config secret")
+		userSecret := v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      unmergeName,
+				Namespace: secretNamespace,
+			},
+			Type: v1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{".dockerconfigjson": []byte(userConfig)},
+		}
+
+		Expect(k8sClient.Create(ctx, &userSecret)).Should(Succeed())
+
+		By("By creating a new ECRSecret that merges into it")
+		ecrsecret := newECRSecret(unmergeName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.Merge = true
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		mergedSecret := &v1.Secret{}
+
+		Eventually(func() bool {
+			if err := k8sClient.Get(ctx, unmergeLookupKey, mergedSecret); err != nil {
+				return false
+			}
+			return ksecret.IsMerged(mergedSecret)
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		By("Turning merge off")
+		Eventually(func() error {
+			if err := k8sClient.Get(ctx, types.NamespacedName{Name: unmergeName, Namespace: secretNamespace}, ecrsecret); err != nil {
+				return err
+			}
+			ecrsecret.Spec.Merge = false
+			return k8sClient.Update(ctx, ecrsecret)
+		}, time.Second*5, time.Second).Should(Succeed())
+
+		By("Checking the merge is released and the user's secret is otherwise untouched")
+		Eventually(func() bool {
+			if err := k8sClient.Get(ctx, unmergeLookupKey, mergedSecret); err != nil {
+				return false
+			}
+			return !ksecret.IsMerged(mergedSecret)
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		Expect(mergedSecret.Data[".dockerconfigjson"]).To(MatchJSON(userConfig))
+		Expect(mergedSecret.OwnerReferences).To(BeEmpty())
+
+		By("Checking the ECRSecret reports the conflict")
+		Eventually(func() string {
+			got := secretsv1.ECRSecret{}
+			if err := k8sClient.Get(ctx, types.NamespacedName{Name: unmergeName, Namespace: secretNamespace}, &got); err != nil {
+				return ""
+			}
+			if cond := meta.FindStatusCondition(got.Status.Conditions, secretsv1.ConditionConflict); cond != nil {
+				return cond.Reason
+			}
+			return ""
+		}, time.Second*5, time.Second).Should(Equal(CONFLICT_REASON_NOT_MANAGED))
+
+		Consistently(func() []byte {
+			if err := k8sClient.Get(ctx, unmergeLookupKey, mergedSecret); err != nil {
+				return nil
+			}
+			return mergedSecret.Data[".dockerconfigjson"]
+		}, time.Second*2, time.Second).Should(MatchJSON(userConfig))
+	})
+})
+
+var _ = Describe("Additional Auths", func() {
+	It("Should include auths from other secrets and follow changes to them", func() {
+
+		ctx := context.Background()
+		additionalName := "additional-auths"
+		sourceName := "dockerhub-secret"
+		additionalLookupKey := types.NamespacedName{Name: additionalName, Namespace: secretNamespace}
+
+		By("By creating a docker config secret for another registry")
+		source := v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      sourceName,
+				Namespace: secretNamespace,
+			},
+			Type: v1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{".dockerconfigjson": []byte(`{"auths":{"docker.io":{"auth":"dXNlcjpwYXNz"}}}`)},
+		}
+
+		Expect(k8sClient.Create(ctx, &source)).Should(Succeed())
+
+		By("By creating a new ECRSecret that takes auths from it")
+		ecrsecret := newECRSecret(additionalName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.AdditionalAuthsFrom = []v1.LocalObjectReference{{Name: sourceName}}
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		getAuths := func() map[string]map[string]string {
+			createdSecret := &v1.Secret{}
+			if err := k8sClient.Get(ctx, additionalLookupKey, createdSecret); err != nil {
+				return nil
+			}
+			config := map[string]map[string]map[string]string{}
+			if err := json.Unmarshal(createdSecret.Data[".dockerconfigjson"], &config); err != nil {
+				return nil
+			}
+			return config["auths"]
+		}
+
+		Eventually(getAuths, time.Second*5, time.Second).Should(And(HaveKey("docker.io"), HaveKey(aws.TEST_REGISTRY)))
+
+		By("Changing the other secret")
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: sourceName, Namespace: secretNamespace}, &source)).Should(Succeed())
+		source.Data[".dockerconfigjson"] = []byte(`{"auths":{"ghcr.io":{"auth":"Z2g6dG9rZW4="}}}`)
+		Expect(k8sClient.Update(ctx, &source)).Should(Succeed())
+
+		Eventually(getAuths, time.Second*5, time.Second).Should(And(HaveKey("ghcr.io"), Not(HaveKey("docker.io")), HaveKey(aws.TEST_REGISTRY)))
+
+		By("Deleting the other secret")
+		Expect(k8sClient.Delete(ctx, &source)).Should(Succeed())
+
+		Eventually(getAuths, time.Second*5, time.Second).Should(And(Not(HaveKey("ghcr.io")), HaveKey(aws.TEST_REGISTRY)))
+
+		Eventually(func() bool {
+			if err := k8sClient.Get(ctx, types.NamespacedName{Name: additionalName, Namespace: secretNamespace}, ecrsecret); err != nil {
+				return false
+			}
+			return meta.IsStatusConditionFalse(ecrsecret.Status.Conditions, secretsv1.ConditionAdditionalAuths)
+		}, time.Second*5, time.Second).Should(BeTrue())
+	})
+})
+
+var _ = Describe("ClusterECRSecret", func() {
+	It("Should create secrets in selected namespaces and remove them when no longer selected", func() {
+
+		ctx := context.Background()
+		clusterName := "cluster-secret"
+		selectedNs := "cluster-selected"
+		otherNs := "cluster-other"
+		selectorLabel := "ecr-pull-secret"
+
+		By("By creating one selected and one unselected namespace")
+		for _, name := range []string{selectedNs, otherNs} {
+			ns := v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+			if name == selectedNs {
+				ns.Labels = map[string]string{selectorLabel: "true"}
+			}
+			Expect(k8sClient.Create(ctx, &ns)).Should(Succeed())
+		}
+
+		By("By creating a new ClusterECRSecret")
+		clusterSecret := secretsv1.ClusterECRSecret{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: secretsv1.GroupVersion.String(),
+				Kind:       "ClusterECRSecret",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: clusterName,
+			},
+			Spec: secretsv1.ClusterECRSecretSpec{
+				Template: secretsv1.ECRSecretSpec{
+					Registry: aws.TEST_REGISTRY,
+				},
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{selectorLabel: "true"},
+				},
+			},
+		}
+
+		Expect(k8sClient.Create(ctx, &clusterSecret)).Should(Succeed())
+
+		By("Checking the secret is generated in the selected namespace only")
+		Eventually(func() error {
+			return k8sClient.Get(ctx, types.NamespacedName{Name: clusterName + "-secret", Namespace: selectedNs}, &v1.Secret{})
+		}, time.Second*5, time.Second).Should(Succeed())
+
+		Consistently(func() bool {
+			err := k8sClient.Get(ctx, types.NamespacedName{Name: clusterName, Namespace: otherNs}, &secretsv1.ECRSecret{})
+			return apierrs.IsNotFound(err)
+		}, time.Second*2, time.Second).Should(BeTrue())
+
+		Eventually(func() int {
+			got := secretsv1.ClusterECRSecret{}
+			if err := k8sClient.Get(ctx, types.NamespacedName{Name: clusterName}, &got); err != nil {
+				return -1
+			}
+			return got.Status.SyncedNamespaces
+		}, time.Second*5, time.Second).Should(Equal(1))
+
+		By("Selecting the other namespace by adding it to the include list")
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: clusterName}, &clusterSecret)).Should(Succeed())
+		clusterSecret.Spec.IncludeNamespaces = []string{otherNs}
+		Expect(k8sClient.Update(ctx, &clusterSecret)).Should(Succeed())
+
+		Eventually(func() error {
+			return k8sClient.Get(ctx, types.NamespacedName{Name: clusterName, Namespace: otherNs}, &secretsv1.ECRSecret{})
+		}, time.Second*5, time.Second).Should(Succeed())
+
+		By("Removing the label from the selected namespace")
+		ns := v1.Namespace{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: selectedNs}, &ns)).Should(Succeed())
+		delete(ns.Labels, selectorLabel)
+		Expect(k8sClient.Update(ctx, &ns)).Should(Succeed())
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, types.NamespacedName{Name: clusterName, Namespace: selectedNs}, &secretsv1.ECRSecret{})
+			return apierrs.IsNotFound(err)
+		}, time.Second*5, time.Second).Should(BeTrue())
+	})
+
+	It("Should report a conflict with an ECRSecret it does not manage", func() {
+
+		ctx := context.Background()
+		conflictName := "cluster-conflict"
+
+		By("By creating an ECRSecret of the same name")
+		ecrsecret := newECRSecret(conflictName, secretNamespace)
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		clusterSecret := secretsv1.ClusterECRSecret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: conflictName,
+			},
+			Spec: secretsv1.ClusterECRSecretSpec{
+				Template: secretsv1.ECRSecretSpec{
+					Registry: aws.TEST_REGISTRY,
+				},
+				IncludeNamespaces: []string{secretNamespace},
+			},
+		}
+
+		Expect(k8sClient.Create(ctx, &clusterSecret)).Should(Succeed())
+
+		Eventually(func() secretsv1.NamespaceSyncState {
+			got := secretsv1.ClusterECRSecret{}
+			if err := k8sClient.Get(ctx, types.NamespacedName{Name: conflictName}, &got); err != nil || len(got.Status.Namespaces) == 0 {
+				return ""
+			}
+			return got.Status.Namespaces[0].State
+		}, time.Second*5, time.Second).Should(Equal(secretsv1.NamespaceSyncStateConflict))
+	})
+})
+
+var _ = Describe("Service Accounts", func() {
+	It("Should add the secret to selected service accounts and remove it on deletion", func() {
+
+		ctx := context.Background()
+		saName := "sa-secret"
+		saLookupKey := types.NamespacedName{Name: "builder", Namespace: secretNamespace}
+
+		By("By creating a service account with a pull secret owned by someone else")
+		sa := v1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      saLookupKey.Name,
+				Namespace: secretNamespace,
+				Labels:    map[string]string{"ecr-pull": "true"},
+			},
+			ImagePullSecrets: []v1.LocalObjectReference{{Name: "dockerhub"}},
+		}
+
+		Expect(k8sClient.Create(ctx, &sa)).Should(Succeed())
+
+		By("By creating a new ECRSecret selecting it")
+		ecrsecret := newECRSecret(saName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.ServiceAccounts = &secretsv1.ServiceAccountSelector{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"ecr-pull": "true"}},
+			}
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		getPullSecrets := func() []string {
+			got := v1.ServiceAccount{}
+			if err := k8sClient.Get(ctx, saLookupKey, &got); err != nil {
+				return nil
+			}
+			var names []string
+			for _, ref := range got.ImagePullSecrets {
+				names = append(names, ref.Name)
+			}
+			return names
+		}
+
+		Eventually(getPullSecrets, time.Second*5, time.Second).Should(Equal([]string{"dockerhub", saName}))
+
+		By("Removing the reference by hand")
+		Expect(k8sClient.Get(ctx, saLookupKey, &sa)).Should(Succeed())
+		sa.ImagePullSecrets = []v1.LocalObjectReference{{Name: "dockerhub"}}
+		Expect(k8sClient.Update(ctx, &sa)).Should(Succeed())
+
+		Eventually(getPullSecrets, time.Second*5, time.Second).Should(Equal([]string{"dockerhub", saName}))
+
+		By("Deleting the ECRSecret")
+		Expect(k8sClient.Delete(ctx, ecrsecret)).Should(Succeed())
+
+		Eventually(getPullSecrets, time.Second*5, time.Second).Should(Equal([]string{"dockerhub"}))
+	})
+	It("Should remove the old secret name when it changes and keep service accounts in step while suspended", func() {
+
+		ctx := context.Background()
+		saName := "sa-rename"
+		saLookupKey := types.NamespacedName{Name: saName, Namespace: secretNamespace}
+		ecrLookupKey := types.NamespacedName{Name: saName, Namespace: secretNamespace}
+
+		By("By creating a service account")
+		sa := v1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      saName,
+				Namespace: secretNamespace,
+			},
+		}
+
+		Expect(k8sClient.Create(ctx, &sa)).Should(Succeed())
+
+		By("By creating a new ECRSecret naming it")
+		ecrsecret := newECRSecret(saName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.ServiceAccounts = &secretsv1.ServiceAccountSelector{Names: []string{saName}}
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		getPullSecrets := func() []string {
+			got := v1.ServiceAccount{}
+			if err := k8sClient.Get(ctx, saLookupKey, &got); err != nil {
+				return nil
+			}
+			var names []string
+			for _, ref := range got.ImagePullSecrets {
+				names = append(names, ref.Name)
+			}
+			return names
+		}
+
+		Eventually(getPullSecrets, time.Second*5, time.Second).Should(Equal([]string{saName}))
+
+		updateECRSecret := func(mutate func(*secretsv1.ECRSecret)) {
+			Eventually(func() error {
+				if err := k8sClient.Get(ctx, ecrLookupKey, ecrsecret); err != nil {
+					return err
+				}
+				mutate(ecrsecret)
+				return k8sClient.Update(ctx, ecrsecret)
+			}, time.Second*5, time.Second).Should(Succeed())
+		}
+
+		By("Changing the secret name")
+		updateECRSecret(func(e *secretsv1.ECRSecret) { e.Spec.SecretName = saName + "-renamed" })
+
+		Eventually(getPullSecrets, time.Second*5, time.Second).Should(Equal([]string{saName + "-renamed"}))
+
+		By("Suspending the ECRSecret and deselecting the service account")
+		updateECRSecret(func(e *secretsv1.ECRSecret) {
+			e.Spec.Suspend = true
+			e.Spec.ServiceAccounts.Names = nil
+		})
+
+		Eventually(getPullSecrets, time.Second*5, time.Second).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Registry Discovery", func() {
+	It("Should create an ECRSecret for a registry in use and remove it when no longer used", func() {
+
+		ctx := context.Background()
+		discoveryNs := "discovery"
+		discoveredKey := types.NamespacedName{Name: "ecr-123456789012-eu-west-1", Namespace: discoveryNs}
+
+		By("By creating an opted in namespace")
+		ns := v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   discoveryNs,
+				Labels: map[string]string{LABEL_DISCOVER_REGISTRIES: DISCOVERY_ENABLED},
+			},
+		}
+
+		Expect(k8sClient.Create(ctx, &ns)).Should(Succeed())
+
+		By("By creating a deployment using the registry")
+		labels := map[string]string{"app": "discovery"}
+		deployment := appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app",
+				Namespace: discoveryNs,
+			},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: v1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: labels},
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{
+							{Name: "app", Image: aws.TEST_REGISTRY + "/app:latest"},
+							{Name: "sidecar", Image: "busybox"},
+						},
+					},
+				},
+			},
+		}
+
+		Expect(k8sClient.Create(ctx, &deployment)).Should(Succeed())
+
+		discovered := &secretsv1.ECRSecret{}
+
+		Eventually(func() error {
+			return k8sClient.Get(ctx, discoveredKey, discovered)
+		}, time.Second*5, time.Second).Should(Succeed())
+
+		Expect(discovered.Labels[secretsv1.LabelDiscovered]).To(Equal("true"))
+		Expect(discovered.Spec.Registry).To(Equal(aws.TEST_REGISTRY))
+
+		By("Deleting the deployment")
+		Expect(k8sClient.Delete(ctx, &deployment)).Should(Succeed())
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, discoveredKey, discovered)
+			return err == nil && discovered.Annotations[ANNOTATION_UNUSED_SINCE] != ""
+		}, time.Second*5, time.Millisecond*250).Should(BeTrue())
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, discoveredKey, &secretsv1.ECRSecret{})
+			return apierrs.IsNotFound(err)
+		}, time.Second*10, time.Second).Should(BeTrue())
+	})
+
+	It("Should not create an ECRSecret in a namespace that has not opted in", func() {
+
+		ctx := context.Background()
+
+		By("By creating a pod in a namespace that has not opted in")
+		pod := v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "discovery-not-opted-in",
+				Namespace: secretNamespace,
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{
+					{Name: "app", Image: aws.TEST_REGISTRY + "/app:latest"},
+				},
+			},
+		}
+
+		Expect(k8sClient.Create(ctx, &pod)).Should(Succeed())
+
+		Consistently(func() bool {
+			err := k8sClient.Get(ctx, types.NamespacedName{Name: "ecr-123456789012-eu-west-1", Namespace: secretNamespace}, &secretsv1.ECRSecret{})
+			return apierrs.IsNotFound(err)
+		}, time.Second*2, time.Second).Should(BeTrue())
+	})
+	It("Should only map workloads in namespaces that have opted in", func() {
+
+		ctx := context.Background()
+		mappingNs := "discovery-mapping"
+		r := &RegistryDiscoveryReconciler{Client: k8sClient}
+
+		By("By creating an opted in namespace")
+		ns := v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   mappingNs,
+				Labels: map[string]string{LABEL_DISCOVER_REGISTRIES: DISCOVERY_ENABLED},
+			},
+		}
+
+		Expect(k8sClient.Create(ctx, &ns)).Should(Succeed())
+
+		optedIn := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: mappingNs}}
+		notOptedIn := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: secretNamespace}}
+
+		Eventually(func() []reconcile.Request {
+			return r.mapToNamespace(optedIn)
+		}, time.Second*5, time.Millisecond*250).Should(ConsistOf(reconcile.Request{NamespacedName: types.NamespacedName{Name: mappingNs}}))
+
+		Expect(r.isInDiscoveryNamespace(notOptedIn)).To(BeFalse())
+		Expect(r.mapToNamespace(notOptedIn)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Pull Failure Refresh", func() {
+	It("Should request a refresh when the registry rejects a pod's pull", func() {
+
+		ctx := context.Background()
+		pfName := "pull-failure"
+		pfLookupKey := types.NamespacedName{Name: pfName, Namespace: secretNamespace}
+		image := aws.TEST_REGISTRY + "/app:latest"
+
+		By("By creating a new ECRSecret")
+		ecrsecret := newECRSecret(pfName, secretNamespace)
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, pfLookupKey, ecrsecret)
+			return err == nil && ecrsecret.Status.LastUpdated != nil
+		}, time.Second*5, time.Second).Should(BeTrue())
+
+		// Let the minimum interval since the secret was generated pass
+		time.Sleep(time.Second * 2)
+
+		By("By creating a pod using the secret whose pull is rejected")
+		pod := v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      pfName,
+				Namespace: secretNamespace,
+			},
+			Spec: v1.PodSpec{
+				Containers:       []v1.Container{{Name: "app", Image: image}},
+				ImagePullSecrets: []v1.LocalObjectReference{{Name: pfName}},
+			},
+		}
+
+		Expect(k8sClient.Create(ctx, &pod)).Should(Succeed())
+
+		pod.Status.ContainerStatuses = []v1.ContainerStatus{
+			{
+				Name:  "app",
+				Image: image,
+				State: v1.ContainerState{
+					Waiting: &v1.ContainerStateWaiting{
+						Reason:  REASON_ERR_IMAGE_PULL,
+						Message: "failed to resolve reference: unexpected status code 401 Unauthorized",
+					},
+				},
+			},
+		}
+
+		Expect(k8sClient.Status().Update(ctx, &pod)).Should(Succeed())
+
+		Eventually(func() string {
+			got := secretsv1.ECRSecret{}
+			if err := k8sClient.Get(ctx, pfLookupKey, &got); err != nil {
+				return ""
+			}
+			return got.Annotations[secretsv1.AnnotationRefreshRequestedAt]
+		}, time.Second*5, time.Millisecond*250).ShouldNot(BeEmpty())
+	})
+
+	Context("Pull failure events", func() {
+		It("Should get the image of a rejected pull", func() {
+			event := v1.Event{
+				InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "app"},
+				Reason:         REASON_FAILED,
+				Message:        `Failed to pull image "` + aws.TEST_REGISTRY + `/app:latest": rpc error: code = Unknown desc = no basic auth credentials`,
+			}
+
+			failure, ok := getEventPullFailure(&event)
+
+			Expect(ok).To(BeTrue())
+			Expect(failure.image).To(Equal(aws.TEST_REGISTRY + "/app:latest"))
+		})
+
+		It("Should ignore a pull that failed for another reason", func() {
+			event := v1.Event{
+				InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "app"},
+				Reason:         REASON_FAILED,
+				Message:        `Failed to pull image "` + aws.TEST_REGISTRY + `/app:latest": not found`,
+			}
+
+			_, ok := getEventPullFailure(&event)
+
+			Expect(ok).To(BeFalse())
+		})
+
+		It("Should request a refresh for a rejected pull event about the pod", func() {
+
+			ctx := context.Background()
+			pfName := "pull-failure-event"
+			pfLookupKey := types.NamespacedName{Name: pfName, Namespace: secretNamespace}
+			image := aws.TEST_REGISTRY + "/app:latest"
+
+			By("By creating a new ECRSecret")
+			ecrsecret := newECRSecret(pfName, secretNamespace)
+
+			Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, pfLookupKey, ecrsecret)
+				return err == nil && ecrsecret.Status.LastUpdated != nil
+			}, time.Second*5, time.Second).Should(BeTrue())
+
+			// Let the minimum interval since the secret was generated pass
+			time.Sleep(time.Second * 2)
+
+			By("By creating a pod using the secret")
+			pod := v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      pfName,
+					Namespace: secretNamespace,
+				},
+				Spec: v1.PodSpec{
+					Containers:       []v1.Container{{Name: "app", Image: image}},
+					ImagePullSecrets: []v1.LocalObjectReference{{Name: pfName}},
+				},
+			}
+
+			Expect(k8sClient.Create(ctx, &pod)).Should(Succeed())
+
+			By("By recording a rejected pull event for the pod")
+			event := v1.Event{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      pfName + ".pull",
+					Namespace: secretNamespace,
+				},
+				InvolvedObject: v1.ObjectReference{
+					Kind:      "Pod",
+					Name:      pod.Name,
+					Namespace: pod.Namespace,
+					UID:       pod.UID,
+				},
+				Reason:        REASON_FAILED,
+				Message:       `Failed to pull image "` + image + `": rpc error: code = Unknown desc = no basic auth credentials`,
+				LastTimestamp: metav1.Now(),
+			}
+
+			Expect(k8sClient.Create(ctx, &event)).Should(Succeed())
+
+			Eventually(func() string {
+				got := secretsv1.ECRSecret{}
+				if err := k8sClient.Get(ctx, pfLookupKey, &got); err != nil {
+					return ""
+				}
+				return got.Annotations[secretsv1.AnnotationRefreshRequestedAt]
+			}, time.Second*5, time.Millisecond*250).ShouldNot(BeEmpty())
+		})
+
+		It("Should only pass events whose reason may be a failed pull", func() {
+			Expect(isPullFailureEventReason(&v1.Event{Reason: REASON_FAILED})).To(BeTrue())
+			Expect(isPullFailureEventReason(&v1.Event{Reason: REASON_BACK_OFF})).To(BeTrue())
+			Expect(isPullFailureEventReason(&v1.Event{Reason: "Scheduled"})).To(BeFalse())
+		})
+	})
+
+	Context("Rate limit", func() {
+		testClock := &clock.TestClock{}
+		r := &PullFailureReconciler{MinInterval: time.Minute, Clock: testClock}
+
+		It("Should not request a refresh within the minimum interval of the last request", func() {
+			testClock.SetTime("2023-01-01T12:00:30Z")
+			ecrsecret := newECRSecret("rate-limit", secretNamespace, func(e *secretsv1.ECRSecret) {
+				e.Annotations = map[string]string{secretsv1.AnnotationRefreshRequestedAt: "2023-01-01T12:00:00Z"}
+			})
+
+			Expect(r.shouldRefresh(ecrsecret, pullFailure{})).To(BeFalse())
+
+			testClock.SetTime("2023-01-01T12:01:00Z")
+			Expect(r.shouldRefresh(ecrsecret, pullFailure{})).To(BeTrue())
+		})
+	})
+})
+
+var _ = Describe("Usage", func() {
+	It("Should count service accounts using the secret and flag it unused when they stop", func() {
+
+		ctx := context.Background()
+		usageName := "usage-secret"
+		usageLookupKey := types.NamespacedName{Name: usageName, Namespace: secretNamespace}
+
+		By("By creating a new ECRSecret")
+		ecrsecret := newECRSecret(usageName, secretNamespace)
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+
+		By("By creating a service account referencing the secret")
+		sa := v1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      usageName,
+				Namespace: secretNamespace,
+			},
+			ImagePullSecrets: []v1.LocalObjectReference{{Name: usageName}},
+		}
+
+		Expect(k8sClient.Create(ctx, &sa)).Should(Succeed())
+
+		getUsage := func() *secretsv1.ECRSecretStatus {
+			got := secretsv1.ECRSecret{}
+			if err := k8sClient.Get(ctx, usageLookupKey, &got); err != nil {
+				return nil
+			}
+			return &got.Status
+		}
+
+		Eventually(func() int32 {
+			status := getUsage()
+			if status == nil || status.Usage == nil {
+				return -1
+			}
+			return status.Usage.ServiceAccounts
+		}, time.Second*5, time.Millisecond*250).Should(Equal(int32(1)))
+
+		Expect(meta.IsStatusConditionFalse(getUsage().Conditions, secretsv1.ConditionUnused)).To(BeTrue())
+
+		By("Deleting the service account")
+		Expect(k8sClient.Delete(ctx, &sa)).Should(Succeed())
+
+		Eventually(func() bool {
+			status := getUsage()
+			return status != nil && meta.IsStatusConditionTrue(status.Conditions, secretsv1.ConditionUnused)
+		}, time.Second*10, time.Second).Should(BeTrue())
+
+		Expect(getUsage().Usage.ServiceAccounts).To(Equal(int32(0)))
+		Expect(getUsage().Usage.LastUsed).NotTo(BeNil())
+	})
+
+	It("Should keep conditions the ECRSecret reconciler wrote after the usage reconciler read the ECRSecret", func() {
+
+		ctx := context.Background()
+		usageName := "usage-conditions"
+		usageLookupKey := types.NamespacedName{Name: usageName, Namespace: secretNamespace}
+
+		By("By creating a suspended ECRSecret and keeping the copy read before its status is written")
+		ecrsecret := newECRSecret(usageName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.Suspend = true
+		})
+
+		Expect(k8sClient.Create(ctx, ecrsecret)).Should(Succeed())
+		stale := ecrsecret.DeepCopy()
+
+		Eventually(func() bool {
+			got := secretsv1.ECRSecret{}
+			err := k8sClient.Get(ctx, usageLookupKey, &got)
+			return err == nil && meta.IsStatusConditionTrue(got.Status.Conditions, secretsv1.ConditionSuspended)
+		}, time.Second*5, time.Millisecond*250).Should(BeTrue())
+
+		By("Reconciling usage from the stale copy")
+		reconciler := &UsageReconciler{
+			Client:      staleClient{Client: k8sClient, stale: stale},
+			Scheme:      k8sManager.GetScheme(),
+			UnusedAfter: time.Hour,
+			Clock:       clock.RealClock{},
+		}
+
+		result, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: usageLookupKey})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Requeue).To(BeTrue())
+
+		By("Checking the usage reconciler keeps the Suspended condition")
+		Eventually(func() bool {
+			got := secretsv1.ECRSecret{}
+			if err := k8sClient.Get(ctx, usageLookupKey, &got); err != nil {
+				return false
+			}
+			return got.Status.Usage != nil &&
+				meta.FindStatusCondition(got.Status.Conditions, secretsv1.ConditionUnused) != nil &&
+				meta.IsStatusConditionTrue(got.Status.Conditions, secretsv1.ConditionSuspended)
+		}, time.Second*5, time.Millisecond*250).Should(BeTrue())
+	})
+})
+
+// Returns a copy of an object read earlier, as a cache that has not caught up would
+type staleClient struct {
+	client.Client
+	stale *secretsv1.ECRSecret
+}
+
+func (c staleClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+
+	if ecrSecret, ok := obj.(*secretsv1.ECRSecret); ok && key == client.ObjectKeyFromObject(c.stale) {
+		c.stale.DeepCopyInto(ecrSecret)
+		return nil
+	}
+
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+var _ = Describe("CRD errors", func() {
+	invalidRegistry := "docker.io"
+	badSecretName := "should-fail-secret"
+
+	It("Should fail if registry does not match pattern for ECR", func() {
+
+		ctx := context.Background()
+
+		By("By creating a new ECRSecret")
+		ecrsecret := newECRSecret(badSecretName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.Registry = invalidRegistry
+		})
+
+		err := k8sClient.Create(ctx, ecrsecret)
+		Expect(err).To(HaveOccurred())
+
+	})
+
+	It("Should fail if max age exceeds token lifetime", func() {
+
+		ctx := context.Background()
+
+		By("By creating a new ECRSecret")
+		ecrsecret := newECRSecret(badSecretName, secretNamespace, func(e *secretsv1.ECRSecret) {
+			e.Spec.MaxAge = &metav1.Duration{Duration: time.Hour * 13}
+		})
+
+		err := k8sClient.Create(ctx, ecrsecret)
+		Expect(err).To(HaveOccurred())
+
+	})
+
+	It("Should fail if registry aliases are empty, repeated or not host names", func() {
+
+		ctx := context.Background()
+
+		for _, aliases := range [][]secretsv1.RegistryAlias{
+			{""},
+			{"ecr.example.com", "ecr.example.com"},
+			{"not a host"},
+		} {
+			By("By creating a new ECRSecret with invalid aliases")
+			ecrsecret := newECRSecret(badSecretName, secretNamespace, func(e *secretsv1.ECRSecret) {
+				e.Spec.RegistryAliases = aliases
+			})
+
+			err := k8sClient.Create(ctx, ecrsecret)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+})
+
+var _ = Describe("ECRSecret", func() {
+	Context("Rotation Age", func() {
+		It("Should fall back to the default max age when the window does not fit the token lifetime", func() {
+			ecrsecret := newECRSecret("rotation-age", secretNamespace, func(e *secretsv1.ECRSecret) {
+				e.Spec.RefreshBefore = &metav1.Duration{Duration: time.Hour*11 + time.Minute*59}
+			})
+			secret := &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{ksecret.ANNOTATION_LIFETIME: "11h59m"},
+				},
+			}
+
+			age, err := getRotationAge(ecrsecret, secret, time.Hour*4)
+			Expect(err).To(HaveOccurred())
+			Expect(age).To(Equal(time.Hour * 4))
+		})
 	})
-})
 
-var _ = Describe("ECRSecret", func() {
 	Context("Get Secret Name", func() {
 		It("Should return generated name if no specific name provided", func() {
 			expected := "test-secret"
-			sec := secretsv1beta1.ECRSecret{
+			sec := secretsv1.ECRSecret{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "test",
 				},
-				Spec: secretsv1beta1.ECRSecretSpec{},
+				Spec: secretsv1.ECRSecretSpec{},
 			}
 
 			Expect(getKubeSecretName(&sec)).To(Equal(expected))
 		})
 		It("Should return specific name if specific name provided", func() {
 			expected := "my=secret"
-			sec := secretsv1beta1.ECRSecret{
+			sec := secretsv1.ECRSecret{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "test",
 				},
-				Spec: secretsv1beta1.ECRSecretSpec{
+				Spec: secretsv1.ECRSecretSpec{
 					SecretName: expected,
 				},
 			}
@@ -0,0 +1,324 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	"github.com/fireflycons/ecr-secret-operator/internal/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// How often usage is recounted, in addition to when pods and service accounts change
+const USAGE_CHECK_INTERVAL = time.Minute * 10
+
+// Reasons for the Unused condition
+const (
+	USAGE_REASON_REFERENCED     = "Referenced"
+	USAGE_REASON_RECENTLY_USED  = "RecentlyUsed"
+	USAGE_REASON_NOT_REFERENCED = "NotReferenced"
+)
+
+var (
+	secretPodsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ecrsecret_referencing_pods",
+		Help: "Number of running or pending pods that reference the secret generated by the ECRSecret",
+	}, []string{"namespace", "ecrsecret"})
+
+	secretServiceAccountsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ecrsecret_referencing_service_accounts",
+		Help: "Number of service accounts that reference the secret generated by the ECRSecret",
+	}, []string{"namespace", "ecrsecret"})
+
+	secretUnusedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ecrsecret_unused",
+		Help: "1 if nothing has referenced the secret generated by the ECRSecret for the unused period, else 0",
+	}, []string{"namespace", "ecrsecret"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(secretPodsGauge, secretServiceAccountsGauge, secretUnusedGauge)
+}
+
+// UsageReconciler counts the pods and service accounts that reference the secret generated by
+// each ECRSecret, and flags ECRSecrets whose secret has not been referenced for a while.
+type UsageReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// How long the secret must go unreferenced for the ECRSecret to be flagged Unused
+	UnusedAfter time.Duration
+	clock.Clock
+}
+
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch
+
+// Reconcile recounts the usage of one ECRSecret's secret
+func (r *UsageReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	log.V(5).Info("Begin reconciler")
+
+	ecrSecret := secretsv1.ECRSecret{}
+
+	if err := r.Get(ctx, req.NamespacedName, &ecrSecret); err != nil {
+		if apierrs.IsNotFound(err) {
+			deleteUsageMetrics(req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	if !ecrSecret.DeletionTimestamp.IsZero() || !isPullSecretFormat(&ecrSecret) {
+		deleteUsageMetrics(req.NamespacedName)
+		return ctrl.Result{}, r.clearUsage(ctx, &ecrSecret)
+	}
+
+	usage, err := r.countUsage(ctx, &ecrSecret)
+
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	now := r.Now()
+	original := ecrSecret.DeepCopy()
+
+	referenced := usage.Pods > 0 || usage.ServiceAccounts > 0
+
+	if previous := ecrSecret.Status.Usage; previous != nil {
+		usage.LastUsed = previous.LastUsed
+	}
+
+	// Only move the last used time on once per check, so that the status is not rewritten on every event
+	if referenced && (usage.LastUsed == nil || now.Sub(usage.LastUsed.Time) >= USAGE_CHECK_INTERVAL) {
+		usage.LastUsed = &metav1.Time{Time: now}
+	}
+
+	// Without a record of use, the unused period runs from when the ECRSecret was created
+	lastUsed := ecrSecret.CreationTimestamp.Time
+
+	if usage.LastUsed != nil {
+		lastUsed = usage.LastUsed.Time
+	}
+
+	ecrSecret.Status.Usage = usage
+
+	result := ctrl.Result{RequeueAfter: USAGE_CHECK_INTERVAL}
+	condition := metav1.Condition{
+		Type:               secretsv1.ConditionUnused,
+		ObservedGeneration: ecrSecret.Generation,
+	}
+
+	switch unusedFor := now.Sub(lastUsed); {
+	case referenced:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = USAGE_REASON_REFERENCED
+		condition.Message = fmt.Sprintf("Secret is referenced by %d pods and %d service accounts", usage.Pods, usage.ServiceAccounts)
+	case unusedFor < r.UnusedAfter:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = USAGE_REASON_RECENTLY_USED
+		condition.Message = "Secret is not referenced, but was referenced recently"
+		result = requeueSooner(result, r.UnusedAfter-unusedFor)
+	default:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = USAGE_REASON_NOT_REFERENCED
+		condition.Message = fmt.Sprintf("Secret has not been referenced by any pod or service account since %s", lastUsed.Format(time.RFC3339))
+	}
+
+	meta.SetStatusCondition(&ecrSecret.Status.Conditions, condition)
+
+	secretPodsGauge.WithLabelValues(ecrSecret.Namespace, ecrSecret.Name).Set(float64(usage.Pods))
+	secretServiceAccountsGauge.WithLabelValues(ecrSecret.Namespace, ecrSecret.Name).Set(float64(usage.ServiceAccounts))
+
+	if condition.Status == metav1.ConditionTrue {
+		secretUnusedGauge.WithLabelValues(ecrSecret.Namespace, ecrSecret.Name).Set(1)
+	} else {
+		secretUnusedGauge.WithLabelValues(ecrSecret.Namespace, ecrSecret.Name).Set(0)
+	}
+
+	if equality.Semantic.DeepEqual(original.Status, ecrSecret.Status) {
+		return result, nil
+	}
+
+	if condition.Status == metav1.ConditionTrue && !meta.IsStatusConditionTrue(original.Status.Conditions, secretsv1.ConditionUnused) {
+		log.Info("ECRSecret is unused", "ECRSecret", ecrSecret.Name, "Namespace", ecrSecret.Namespace, "LastUsed", lastUsed)
+	}
+
+	if err := r.patchStatus(ctx, &ecrSecret, original); err != nil {
+		if apierrs.IsConflict(err) {
+			// The ECRSecret reconciler wrote the status since it was read, so count again on a fresh copy
+			log.V(5).Info("ECRSecret changed while writing usage. Requeueing")
+			return ctrl.Result{Requeue: true}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	return result, nil
+}
+
+// Write the status. A merge patch replaces the whole conditions list, so it must only apply to the
+// version that was read, or it would drop conditions the ECRSecret reconciler has set since.
+func (r *UsageReconciler) patchStatus(ctx context.Context, ecrSecret, original *secretsv1.ECRSecret) error {
+	return r.Status().Patch(ctx, ecrSecret, client.MergeFromWithOptions(original, client.MergeFromWithOptimisticLock{}))
+}
+
+// Only secrets of the default format are referenced by pods and service accounts
+func isPullSecretFormat(ecrSecret *secretsv1.ECRSecret) bool {
+	return ecrSecret.Spec.Format == "" || ecrSecret.Spec.Format == secretsv1.SecretFormatDockerConfigJson
+}
+
+// Count the pods and service accounts in the namespace that reference the ECRSecret's secret
+func (r *UsageReconciler) countUsage(ctx context.Context, ecrSecret *secretsv1.ECRSecret) (*secretsv1.SecretUsage, error) {
+
+	secretName := ecrSecret.KubeSecretName()
+	usage := &secretsv1.SecretUsage{}
+
+	pods := corev1.PodList{}
+
+	if err := r.List(ctx, &pods, client.InNamespace(ecrSecret.Namespace)); err != nil {
+		return nil, err
+	}
+
+	for i := range pods.Items {
+
+		pod := &pods.Items[i]
+
+		if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed && referencesPullSecret(pod.Spec.ImagePullSecrets, secretName) {
+			usage.Pods++
+		}
+	}
+
+	serviceAccounts := corev1.ServiceAccountList{}
+
+	if err := r.List(ctx, &serviceAccounts, client.InNamespace(ecrSecret.Namespace)); err != nil {
+		return nil, err
+	}
+
+	for i := range serviceAccounts.Items {
+		if referencesPullSecret(serviceAccounts.Items[i].ImagePullSecrets, secretName) {
+			usage.ServiceAccounts++
+		}
+	}
+
+	return usage, nil
+}
+
+// Remove the usage and Unused condition from an ECRSecret that is no longer tracked
+func (r *UsageReconciler) clearUsage(ctx context.Context, ecrSecret *secretsv1.ECRSecret) error {
+
+	if ecrSecret.Status.Usage == nil && meta.FindStatusCondition(ecrSecret.Status.Conditions, secretsv1.ConditionUnused) == nil {
+		return nil
+	}
+
+	original := ecrSecret.DeepCopy()
+	ecrSecret.Status.Usage = nil
+	meta.RemoveStatusCondition(&ecrSecret.Status.Conditions, secretsv1.ConditionUnused)
+
+	return client.IgnoreNotFound(r.patchStatus(ctx, ecrSecret, original))
+}
+
+func deleteUsageMetrics(name types.NamespacedName) {
+	secretPodsGauge.DeleteLabelValues(name.Namespace, name.Name)
+	secretServiceAccountsGauge.DeleteLabelValues(name.Namespace, name.Name)
+	secretUnusedGauge.DeleteLabelValues(name.Namespace, name.Name)
+}
+
+func referencesPullSecret(refs []corev1.LocalObjectReference, secretName string) bool {
+
+	for _, ref := range refs {
+		if ref.Name == secretName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Map a pod or service account event to the ECRSecrets whose secrets it references
+func (r *UsageReconciler) mapReferencingObject(obj client.Object) []reconcile.Request {
+
+	var refs []corev1.LocalObjectReference
+
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		refs = o.Spec.ImagePullSecrets
+	case *corev1.ServiceAccount:
+		refs = o.ImagePullSecrets
+	}
+
+	if len(refs) == 0 {
+		return nil
+	}
+
+	list := secretsv1.ECRSecretList{}
+
+	if err := r.List(context.Background(), &list, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+
+	var requests []reconcile.Request
+
+	for i := range list.Items {
+
+		ecrSecret := &list.Items[i]
+
+		if referencesPullSecret(refs, ecrSecret.KubeSecretName()) {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: ecrSecret.Name, Namespace: ecrSecret.Namespace},
+			})
+		}
+	}
+
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *UsageReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	if r.Clock == nil {
+		r.Clock = clock.RealClock{}
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("usage").
+		// Our own status writes don't change the usage, so only spec changes are of interest
+		For(&secretsv1.ECRSecret{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, handler.EnqueueRequestsFromMapFunc(r.mapReferencingObject)).
+		Watches(&source.Kind{Type: &corev1.ServiceAccount{}}, handler.EnqueueRequestsFromMapFunc(r.mapReferencingObject)).
+		Complete(r)
+}
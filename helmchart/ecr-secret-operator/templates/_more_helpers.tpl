@@ -25,3 +25,15 @@ secret_key = "{{ $v.secretKey }}"
 {{- define "ecr-secret-operator.imageTag" -}}
 {{ .Values.ecrSecretOperatorControllerManagerDeployment.manager.image.tag | default .Chart.AppVersion }}
 {{- end }}
+
+{{- define "ecr-secret-operator.webhookServiceName" -}}
+ecr-secret-operator-webhook-service
+{{- end }}
+
+{{- define "ecr-secret-operator.webhookCertName" -}}
+ecr-secret-operator-serving-cert
+{{- end }}
+
+{{- define "ecr-secret-operator.webhooksEnabled" -}}
+{{- if or .Values.podWebhook.enabled .Values.ecrSecretWebhooks.enabled .Values.conversionWebhook.enabled .Values.secretProtectionWebhook.enabled }}true{{- end }}
+{{- end }}
@@ -0,0 +1,281 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Self-managed serving certificates for the operator's webhooks
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Keys of the secret the certificates are kept in
+const (
+	CA_CERT_KEY  = "ca.crt"
+	CA_KEY_KEY   = "ca.key"
+	TLS_CERT_KEY = "tls.crt"
+	TLS_KEY_KEY  = "tls.key"
+)
+
+const (
+	CA_LIFETIME   = time.Hour * 24 * 365 * 10
+	CERT_LIFETIME = time.Hour * 24 * 365
+	// Serving certificates are renewed when they have less than this left to run
+	RENEW_BEFORE = time.Hour * 24 * 30
+)
+
+const (
+	ERROR_FMT_NO_PEM  = "no PEM data in '%s'"
+	ERROR_MISSING_KEY = "certificate data is missing '%s'"
+)
+
+// Bundle is a CA and a serving certificate signed by it, PEM encoded
+type Bundle struct {
+	CACert []byte
+	CAKey  []byte
+	Cert   []byte
+	Key    []byte
+}
+
+// Get the DNS names by which the webhook service is reached
+func DNSNames(serviceName, namespace string) []string {
+	return []string{
+		serviceName,
+		fmt.Sprintf("%s.%s", serviceName, namespace),
+		fmt.Sprintf("%s.%s.svc", serviceName, namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", serviceName, namespace),
+	}
+}
+
+// NewBundle generates a new CA and a serving certificate for the DNS names
+func NewBundle(dnsNames []string, now time.Time) (*Bundle, error) {
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{CommonName: "ecr-secret-operator-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CA_LIFETIME),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	caKeyDer, err := x509.MarshalECPrivateKey(caKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &Bundle{
+		CACert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}),
+		CAKey:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: caKeyDer}),
+	}
+
+	return bundle, bundle.Renew(dnsNames, now)
+}
+
+// Renew replaces the serving certificate with a new one signed by the same CA
+func (b *Bundle) Renew(dnsNames []string, now time.Time) error {
+
+	ca, err := parseCert(b.CACert, CA_CERT_KEY)
+
+	if err != nil {
+		return err
+	}
+
+	caKeyBlock, _ := pem.Decode(b.CAKey)
+
+	if caKeyBlock == nil {
+		return fmt.Errorf(ERROR_FMT_NO_PEM, CA_KEY_KEY)
+	}
+
+	caKey, err := x509.ParseECPrivateKey(caKeyBlock.Bytes)
+
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	notAfter := now.Add(CERT_LIFETIME)
+
+	// Never outlive the CA
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: newSerial(),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	b.Cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	b.Key = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	return nil
+}
+
+// NeedsRenewal determines whether the serving certificate is close to expiry,
+// or does not cover the DNS names
+func (b *Bundle) NeedsRenewal(dnsNames []string, now time.Time) bool {
+
+	cert, err := parseCert(b.Cert, TLS_CERT_KEY)
+
+	if err != nil || now.Add(RENEW_BEFORE).After(cert.NotAfter) {
+		return true
+	}
+
+	for _, name := range dnsNames {
+		if cert.VerifyHostname(name) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NeedsNewCA determines whether the CA is unusable or close to expiry
+func (b *Bundle) NeedsNewCA(now time.Time) bool {
+
+	ca, err := parseCert(b.CACert, CA_CERT_KEY)
+
+	return err != nil || now.Add(RENEW_BEFORE).After(ca.NotAfter)
+}
+
+// Data gets the bundle as secret data
+func (b *Bundle) Data() map[string][]byte {
+	return map[string][]byte{
+		CA_CERT_KEY:  b.CACert,
+		CA_KEY_KEY:   b.CAKey,
+		TLS_CERT_KEY: b.Cert,
+		TLS_KEY_KEY:  b.Key,
+	}
+}
+
+// FromData gets a bundle from secret data
+func FromData(data map[string][]byte) (*Bundle, error) {
+
+	for _, key := range []string{CA_CERT_KEY, CA_KEY_KEY, TLS_CERT_KEY, TLS_KEY_KEY} {
+		if len(data[key]) == 0 {
+			return nil, fmt.Errorf(ERROR_MISSING_KEY, key)
+		}
+	}
+
+	return &Bundle{
+		CACert: data[CA_CERT_KEY],
+		CAKey:  data[CA_KEY_KEY],
+		Cert:   data[TLS_CERT_KEY],
+		Key:    data[TLS_KEY_KEY],
+	}, nil
+}
+
+// WriteFiles writes the serving certificate and key where the webhook server expects them, along
+// with the CA, in the same layout as a cert-manager secret. Files are only written if they have
+// changed, so the server's certificate watcher is not triggered needlessly.
+func (b *Bundle) WriteFiles(certDir string) error {
+
+	if err := os.MkdirAll(certDir, 0700); err != nil {
+		return err
+	}
+
+	for name, content := range map[string][]byte{CA_CERT_KEY: b.CACert, TLS_CERT_KEY: b.Cert, TLS_KEY_KEY: b.Key} {
+
+		path := filepath.Join(certDir, name)
+
+		if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, content) {
+			continue
+		}
+
+		// Write then rename, so the server never reads a partial file
+		tmp := path + ".tmp"
+
+		if err := os.WriteFile(tmp, content, 0600); err != nil {
+			return err
+		}
+
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseCert(data []byte, key string) (*x509.Certificate, error) {
+
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, fmt.Errorf(ERROR_FMT_NO_PEM, key)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func newSerial() *big.Int {
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		// The system random source is broken, and nothing will work
+		panic(err)
+	}
+
+	return serial
+}
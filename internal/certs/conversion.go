@@ -0,0 +1,133 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Self-managed serving certificates for the operator's webhooks
+package certs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Port of the webhook service
+const SERVICE_PORT = 443
+
+//+kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;update;patch
+
+// ConversionConfigurer sets CRDs to convert between API versions with the operator's conversion
+// webhook, and keeps their CA bundle up to date. The CA is read from the certificate directory,
+// so it works whether the operator or cert-manager provides the serving certificate.
+type ConversionConfigurer struct {
+	Client      client.Client
+	Namespace   string
+	ServiceName string
+	// Path the conversion webhook is served on
+	Path    string
+	CertDir string
+	// Names of the CRDs to configure
+	CustomResourceDefinitions []string
+}
+
+// Ensure sets the conversion of each CRD that does not already use the webhook with the current CA
+func (c *ConversionConfigurer) Ensure(ctx context.Context) error {
+
+	caBundle, err := os.ReadFile(filepath.Join(c.CertDir, CA_CERT_KEY))
+
+	if err != nil {
+		return err
+	}
+
+	path := c.Path
+	port := int32(SERVICE_PORT)
+
+	conversion := &apiextensionsv1.CustomResourceConversion{
+		Strategy: apiextensionsv1.WebhookConverter,
+		Webhook: &apiextensionsv1.WebhookConversion{
+			ClientConfig: &apiextensionsv1.WebhookClientConfig{
+				Service: &apiextensionsv1.ServiceReference{
+					Namespace: c.Namespace,
+					Name:      c.ServiceName,
+					Path:      &path,
+					Port:      &port,
+				},
+				CABundle: caBundle,
+			},
+			ConversionReviewVersions: []string{"v1"},
+		},
+	}
+
+	for _, name := range c.CustomResourceDefinitions {
+
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+
+		if err := c.Client.Get(ctx, types.NamespacedName{Name: name}, crd); err != nil {
+			if apierrs.IsNotFound(err) {
+				continue
+			}
+
+			return err
+		}
+
+		if equality.Semantic.DeepEqual(crd.Spec.Conversion, conversion) {
+			continue
+		}
+
+		original := crd.DeepCopy()
+		crd.Spec.Conversion = conversion.DeepCopy()
+
+		certLog.Info("Configuring conversion webhook", "CustomResourceDefinition", name)
+
+		if err := c.Client.Patch(ctx, crd, client.MergeFrom(original)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Start configures the CRDs, then checks them until the context is done. The CRDs are only
+// pointed at the webhook once the operator is starting to serve it.
+func (c *ConversionConfigurer) Start(ctx context.Context) error {
+
+	ticker := time.NewTicker(CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Ensure(ctx); err != nil {
+			certLog.Error(err, "Unable to configure conversion webhook")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection is false, as the CRDs must be kept up to date with the certificate
+// whichever replica renews it
+func (c *ConversionConfigurer) NeedLeaderElection() bool {
+	return false
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Self-managed serving certificates for the operator's webhooks
+package certs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fireflycons/ecr-secret-operator/internal/clock"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// How often the certificates and the CA bundles in the webhook configurations are checked
+const CHECK_INTERVAL = time.Minute
+
+// Where the operator's own namespace can be read from when running in a pod
+const SERVICE_ACCOUNT_NAMESPACE_FILE = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Attempts at writing the secret when other replicas are writing it too
+const MAX_ATTEMPTS = 3
+
+var certLog = logf.Log.WithName("webhook-certs")
+
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations;validatingwebhookconfigurations,verbs=get;update;patch
+
+// Manager keeps the webhook serving certificate in a secret shared by all replicas, renews it
+// before it expires, writes it to the webhook server's certificate directory and injects the
+// CA into the webhook configurations. The conversion webhooks of CRDs are configured by a
+// ConversionConfigurer from the CA written here.
+type Manager struct {
+	// Should not be a cached client, as the manager is used before the cache is started
+	Client      client.Client
+	Namespace   string
+	SecretName  string
+	ServiceName string
+	CertDir     string
+	// Names of the webhook configurations to inject the CA into
+	MutatingWebhookConfigurations   []string
+	ValidatingWebhookConfigurations []string
+	clock.Clock
+}
+
+// Get the namespace the operator is running in
+func CurrentNamespace() (string, error) {
+
+	namespace, err := os.ReadFile(SERVICE_ACCOUNT_NAMESPACE_FILE)
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(namespace)), nil
+}
+
+// Ensure brings the certificates up to date. Call it before starting the webhook server,
+// so that the server starts with a certificate.
+func (m *Manager) Ensure(ctx context.Context) error {
+
+	if m.Clock == nil {
+		m.Clock = clock.RealClock{}
+	}
+
+	var (
+		bundle *Bundle
+		err    error
+	)
+
+	for attempt := 1; attempt <= MAX_ATTEMPTS; attempt++ {
+
+		if bundle, err = m.ensureSecret(ctx); err == nil || !(apierrs.IsConflict(err) || apierrs.IsAlreadyExists(err)) {
+			break
+		}
+
+		// Another replica got there first, so use what it wrote
+		certLog.V(5).Info("Certificate secret changed while updating it. Retrying", "attempt", attempt)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = bundle.WriteFiles(m.CertDir); err != nil {
+		return err
+	}
+
+	return m.injectCABundle(ctx, bundle.CACert)
+}
+
+// Start checks the certificates until the context is done
+func (m *Manager) Start(ctx context.Context) error {
+
+	ticker := time.NewTicker(CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := m.Ensure(ctx); err != nil {
+				certLog.Error(err, "Unable to update webhook certificates")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection is false, as every replica serves webhooks and needs the certificate files
+func (m *Manager) NeedLeaderElection() bool {
+	return false
+}
+
+// Get the bundle from the secret, creating or renewing it as necessary
+func (m *Manager) ensureSecret(ctx context.Context) (*Bundle, error) {
+
+	dnsNames := DNSNames(m.ServiceName, m.Namespace)
+	now := m.Now()
+
+	secret := &corev1.Secret{}
+	err := m.Client.Get(ctx, types.NamespacedName{Name: m.SecretName, Namespace: m.Namespace}, secret)
+
+	if apierrs.IsNotFound(err) {
+
+		bundle, err := NewBundle(dnsNames, now)
+
+		if err != nil {
+			return nil, err
+		}
+
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.SecretName,
+				Namespace: m.Namespace,
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: bundle.Data(),
+		}
+
+		certLog.Info("Creating webhook certificates", "secret", m.SecretName)
+
+		return bundle, m.Client.Create(ctx, secret)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := FromData(secret.Data)
+
+	switch {
+	case err != nil || bundle.NeedsNewCA(now):
+		certLog.Info("Generating new webhook CA", "secret", m.SecretName)
+
+		if bundle, err = NewBundle(dnsNames, now); err != nil {
+			return nil, err
+		}
+	case bundle.NeedsRenewal(dnsNames, now):
+		certLog.Info("Renewing webhook certificate", "secret", m.SecretName)
+
+		if err = bundle.Renew(dnsNames, now); err != nil {
+			return nil, err
+		}
+	default:
+		return bundle, nil
+	}
+
+	secret.Data = bundle.Data()
+
+	return bundle, m.Client.Update(ctx, secret)
+}
+
+// Set the CA bundle of every webhook in the configurations, where it is not already set
+func (m *Manager) injectCABundle(ctx context.Context, caBundle []byte) error {
+
+	for _, name := range m.MutatingWebhookConfigurations {
+
+		config := &admissionregistrationv1.MutatingWebhookConfiguration{}
+
+		if err := m.Client.Get(ctx, types.NamespacedName{Name: name}, config); err != nil {
+			if apierrs.IsNotFound(err) {
+				continue
+			}
+
+			return err
+		}
+
+		original := config.DeepCopy()
+		changed := false
+
+		for i := range config.Webhooks {
+			changed = setCABundle(&config.Webhooks[i].ClientConfig, caBundle) || changed
+		}
+
+		if changed {
+			certLog.Info("Injecting CA bundle", "MutatingWebhookConfiguration", name)
+
+			if err := m.Client.Patch(ctx, config, client.MergeFrom(original)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range m.ValidatingWebhookConfigurations {
+
+		config := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+
+		if err := m.Client.Get(ctx, types.NamespacedName{Name: name}, config); err != nil {
+			if apierrs.IsNotFound(err) {
+				continue
+			}
+
+			return err
+		}
+
+		original := config.DeepCopy()
+		changed := false
+
+		for i := range config.Webhooks {
+			changed = setCABundle(&config.Webhooks[i].ClientConfig, caBundle) || changed
+		}
+
+		if changed {
+			certLog.Info("Injecting CA bundle", "ValidatingWebhookConfiguration", name)
+
+			if err := m.Client.Patch(ctx, config, client.MergeFrom(original)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func setCABundle(clientConfig *admissionregistrationv1.WebhookClientConfig, caBundle []byte) bool {
+
+	if bytes.Equal(clientConfig.CABundle, caBundle) {
+		return false
+	}
+
+	clientConfig.CABundle = caBundle
+
+	return true
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Self-managed serving certificates for the operator's webhooks
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fireflycons/ecr-secret-operator/internal/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const (
+	TEST_NAMESPACE  = "test-ns"
+	TEST_SERVICE    = "webhook-service"
+	TEST_SECRET     = "webhook-cert"
+	TEST_MUTATING   = "mutating-webhook-configuration"
+	TEST_VALIDATING = "validating-webhook-configuration"
+	TEST_CRD        = "things.example.com"
+	TEST_OTHER_CRD  = "others.example.com"
+)
+
+func TestCerts(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Certs Suite")
+}
+
+func mustParseCert(data []byte) *x509.Certificate {
+
+	block, _ := pem.Decode(data)
+	Expect(block).NotTo(BeNil())
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	Expect(err).NotTo(HaveOccurred())
+
+	return cert
+}
+
+var _ = Describe("Certs", func() {
+
+	dnsNames := DNSNames(TEST_SERVICE, TEST_NAMESPACE)
+	now := clock.MustParseTime("2023-06-01T00:00:00Z")
+
+	Context("Bundle", func() {
+
+		It("Should generate a serving certificate signed by the CA", func() {
+			bundle, err := NewBundle(dnsNames, now)
+			Expect(err).NotTo(HaveOccurred())
+
+			roots := x509.NewCertPool()
+			Expect(roots.AppendCertsFromPEM(bundle.CACert)).To(BeTrue())
+
+			for _, name := range dnsNames {
+				_, err := mustParseCert(bundle.Cert).Verify(x509.VerifyOptions{
+					DNSName:     name,
+					Roots:       roots,
+					CurrentTime: now,
+				})
+				Expect(err).NotTo(HaveOccurred(), name)
+			}
+		})
+
+		It("Should need renewal only when close to expiry or the names change", func() {
+			bundle, err := NewBundle(dnsNames, now)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(bundle.NeedsRenewal(dnsNames, now)).To(BeFalse())
+			Expect(bundle.NeedsRenewal(dnsNames, now.Add(CERT_LIFETIME-RENEW_BEFORE+time.Hour))).To(BeTrue())
+			Expect(bundle.NeedsRenewal(DNSNames("other-service", TEST_NAMESPACE), now)).To(BeTrue())
+			Expect(bundle.NeedsNewCA(now.Add(CERT_LIFETIME))).To(BeFalse())
+			Expect(bundle.NeedsNewCA(now.Add(CA_LIFETIME - RENEW_BEFORE + time.Hour))).To(BeTrue())
+		})
+
+		It("Should renew the certificate with the same CA", func() {
+			bundle, err := NewBundle(dnsNames, now)
+			Expect(err).NotTo(HaveOccurred())
+
+			caCert := bundle.CACert
+			cert := bundle.Cert
+			later := now.Add(CERT_LIFETIME)
+
+			Expect(bundle.Renew(dnsNames, later)).To(Succeed())
+			Expect(bundle.CACert).To(Equal(caCert))
+			Expect(bundle.Cert).NotTo(Equal(cert))
+			Expect(bundle.NeedsRenewal(dnsNames, later)).To(BeFalse())
+		})
+
+		It("Should round trip secret data", func() {
+			bundle, err := NewBundle(dnsNames, now)
+			Expect(err).NotTo(HaveOccurred())
+
+			loaded, err := FromData(bundle.Data())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded).To(Equal(bundle))
+
+			data := bundle.Data()
+			delete(data, TLS_KEY_KEY)
+
+			_, err = FromData(data)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Manager", func() {
+
+		var (
+			k8sClient client.Client
+			manager   *Manager
+			testClock *clock.TestClock
+		)
+
+		ctx := context.Background()
+
+		webhookConfigurations := func() (*admissionregistrationv1.MutatingWebhookConfiguration, *admissionregistrationv1.ValidatingWebhookConfiguration) {
+
+			mutating := &admissionregistrationv1.MutatingWebhookConfiguration{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: TEST_MUTATING}, mutating)).To(Succeed())
+
+			validating := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: TEST_VALIDATING}, validating)).To(Succeed())
+
+			return mutating, validating
+		}
+
+		getSecret := func() *corev1.Secret {
+
+			secret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: TEST_SECRET, Namespace: TEST_NAMESPACE}, secret)).To(Succeed())
+
+			return secret
+		}
+
+		BeforeEach(func() {
+			scheme := runtime.NewScheme()
+			utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+
+			k8sClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+				&admissionregistrationv1.MutatingWebhookConfiguration{
+					ObjectMeta: metav1.ObjectMeta{Name: TEST_MUTATING},
+					Webhooks: []admissionregistrationv1.MutatingWebhook{
+						{Name: "m1.example.com"},
+						{Name: "m2.example.com"},
+					},
+				},
+				&admissionregistrationv1.ValidatingWebhookConfiguration{
+					ObjectMeta: metav1.ObjectMeta{Name: TEST_VALIDATING},
+					Webhooks: []admissionregistrationv1.ValidatingWebhook{
+						{Name: "v1.example.com"},
+					},
+				},
+			).Build()
+
+			testClock = &clock.TestClock{}
+			testClock.Set(now)
+
+			manager = &Manager{
+				Client:                          k8sClient,
+				Namespace:                       TEST_NAMESPACE,
+				SecretName:                      TEST_SECRET,
+				ServiceName:                     TEST_SERVICE,
+				CertDir:                         GinkgoT().TempDir(),
+				MutatingWebhookConfigurations:   []string{TEST_MUTATING, "missing-configuration"},
+				ValidatingWebhookConfigurations: []string{TEST_VALIDATING},
+				Clock:                           testClock,
+			}
+		})
+
+		It("Should create the secret, write the files and inject the CA", func() {
+			Expect(manager.Ensure(ctx)).To(Succeed())
+
+			secret := getSecret()
+
+			bundle, err := FromData(secret.Data)
+			Expect(err).NotTo(HaveOccurred())
+
+			for name, content := range map[string][]byte{CA_CERT_KEY: bundle.CACert, TLS_CERT_KEY: bundle.Cert, TLS_KEY_KEY: bundle.Key} {
+				written, err := os.ReadFile(filepath.Join(manager.CertDir, name))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(written).To(Equal(content))
+			}
+
+			mutating, validating := webhookConfigurations()
+
+			for _, webhook := range mutating.Webhooks {
+				Expect(webhook.ClientConfig.CABundle).To(Equal(bundle.CACert))
+			}
+
+			for _, webhook := range validating.Webhooks {
+				Expect(webhook.ClientConfig.CABundle).To(Equal(bundle.CACert))
+			}
+		})
+
+		It("Should not change a current certificate", func() {
+			Expect(manager.Ensure(ctx)).To(Succeed())
+
+			secret := getSecret()
+			mutating, _ := webhookConfigurations()
+
+			testClock.Set(now.Add(time.Hour))
+			Expect(manager.Ensure(ctx)).To(Succeed())
+
+			Expect(getSecret().ResourceVersion).To(Equal(secret.ResourceVersion))
+
+			mutatingAfter, _ := webhookConfigurations()
+			Expect(mutatingAfter.ResourceVersion).To(Equal(mutating.ResourceVersion))
+		})
+
+		It("Should renew the certificate close to expiry", func() {
+			Expect(manager.Ensure(ctx)).To(Succeed())
+
+			before, err := FromData(getSecret().Data)
+			Expect(err).NotTo(HaveOccurred())
+
+			testClock.Set(now.Add(CERT_LIFETIME - RENEW_BEFORE + time.Hour))
+			Expect(manager.Ensure(ctx)).To(Succeed())
+
+			after, err := FromData(getSecret().Data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(after.CACert).To(Equal(before.CACert))
+			Expect(after.Cert).NotTo(Equal(before.Cert))
+
+			written, err := os.ReadFile(filepath.Join(manager.CertDir, TLS_CERT_KEY))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(written).To(Equal(after.Cert))
+		})
+	})
+
+	Context("ConversionConfigurer", func() {
+
+		var (
+			k8sClient  client.Client
+			configurer *ConversionConfigurer
+			bundle     *Bundle
+		)
+
+		ctx := context.Background()
+
+		getConversion := func(name string) *apiextensionsv1.CustomResourceConversion {
+
+			crd := &apiextensionsv1.CustomResourceDefinition{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name}, crd)).To(Succeed())
+
+			return crd.Spec.Conversion
+		}
+
+		BeforeEach(func() {
+			scheme := runtime.NewScheme()
+			utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
+
+			k8sClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+				&apiextensionsv1.CustomResourceDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: TEST_CRD},
+					Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+						Conversion: &apiextensionsv1.CustomResourceConversion{
+							Strategy: apiextensionsv1.NoneConverter,
+						},
+					},
+				},
+				&apiextensionsv1.CustomResourceDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: TEST_OTHER_CRD},
+					Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+						Conversion: &apiextensionsv1.CustomResourceConversion{
+							Strategy: apiextensionsv1.NoneConverter,
+						},
+					},
+				},
+			).Build()
+
+			var err error
+			bundle, err = NewBundle(dnsNames, now)
+			Expect(err).NotTo(HaveOccurred())
+
+			configurer = &ConversionConfigurer{
+				Client:                    k8sClient,
+				Namespace:                 TEST_NAMESPACE,
+				ServiceName:               TEST_SERVICE,
+				Path:                      "/convert",
+				CertDir:                   GinkgoT().TempDir(),
+				CustomResourceDefinitions: []string{TEST_CRD, "missing.example.com"},
+			}
+
+			Expect(bundle.WriteFiles(configurer.CertDir)).To(Succeed())
+		})
+
+		It("Should set the CRDs to convert with the webhook", func() {
+			Expect(configurer.Ensure(ctx)).To(Succeed())
+
+			conversion := getConversion(TEST_CRD)
+			Expect(conversion.Strategy).To(Equal(apiextensionsv1.WebhookConverter))
+			Expect(conversion.Webhook.ConversionReviewVersions).To(Equal([]string{"v1"}))
+
+			clientConfig := conversion.Webhook.ClientConfig
+			Expect(clientConfig.CABundle).To(Equal(bundle.CACert))
+			Expect(clientConfig.Service.Namespace).To(Equal(TEST_NAMESPACE))
+			Expect(clientConfig.Service.Name).To(Equal(TEST_SERVICE))
+			Expect(*clientConfig.Service.Path).To(Equal("/convert"))
+			Expect(*clientConfig.Service.Port).To(Equal(int32(SERVICE_PORT)))
+
+			Expect(getConversion(TEST_OTHER_CRD).Strategy).To(Equal(apiextensionsv1.NoneConverter))
+		})
+
+		It("Should only update a CRD when the CA changes", func() {
+			Expect(configurer.Ensure(ctx)).To(Succeed())
+
+			crd := &apiextensionsv1.CustomResourceDefinition{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: TEST_CRD}, crd)).To(Succeed())
+			resourceVersion := crd.ResourceVersion
+
+			Expect(configurer.Ensure(ctx)).To(Succeed())
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: TEST_CRD}, crd)).To(Succeed())
+			Expect(crd.ResourceVersion).To(Equal(resourceVersion))
+
+			renewed, err := NewBundle(dnsNames, now.Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(renewed.WriteFiles(configurer.CertDir)).To(Succeed())
+
+			Expect(configurer.Ensure(ctx)).To(Succeed())
+			Expect(getConversion(TEST_CRD).Webhook.ClientConfig.CABundle).To(Equal(renewed.CACert))
+		})
+
+		It("Should fail while there is no CA", func() {
+			Expect(os.Remove(filepath.Join(configurer.CertDir, CA_CERT_KEY))).To(Succeed())
+
+			Expect(configurer.Ensure(ctx)).NotTo(Succeed())
+			Expect(getConversion(TEST_CRD).Strategy).To(Equal(apiextensionsv1.NoneConverter))
+		})
+	})
+})
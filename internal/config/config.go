@@ -19,6 +19,7 @@ package config
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/fireflycons/ecr-secret-operator/internal/aws"
@@ -74,3 +75,31 @@ func LoadCredentials(config io.Reader, accountId string) (*aws.Credentials, erro
 
 	return nil, fmt.Errorf("FATAL: %s", strings.Join(errors, ", "))
 }
+
+// Load the IDs of the AWS accounts that have both keys in the config
+func LoadAccounts(config io.Reader) ([]string, error) {
+
+	var configuration Configuration
+
+	err := toml.NewDecoder(config).Decode(&configuration)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []string
+
+	for accountId, creds := range configuration {
+
+		_, ok1 := creds[ACCESS_KEY]
+		_, ok2 := creds[SECRET_KEY]
+
+		if ok1 && ok2 {
+			accounts = append(accounts, accountId)
+		}
+	}
+
+	sort.Strings(accounts)
+
+	return accounts, nil
+}
@@ -103,5 +103,15 @@ secret_key = "secretEXAMPLE2"`
 
 			Expect(*creds).To(Equal(expected))
 		})
+
+		It("Should load the configured accounts", func() {
+			accounts, err := LoadAccounts(strings.NewReader(toml + `
+
+[999999999999]
+access_key = "AKAIEXAMPLE3"`))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(accounts).To(Equal([]string{"123456789012", "2109878654321"}))
+		})
 	})
 })
@@ -20,30 +20,77 @@ package ksecret
 import (
 	"crypto/md5"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fireflycons/ecr-secret-operator/internal/aws"
 	"github.com/fireflycons/ecr-secret-operator/internal/clock"
 	"github.com/google/uuid"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// All annotations owned by the operator begin with this
+const ANNOTATION_PREFIX = "secrets.fireflycons.io/"
+
+// API group of the operator's resources
+const API_GROUP = "secrets.fireflycons.io"
+
 const (
 	ANNOTATION_UID      = "secrets.fireflycons.io/uuid"
 	ANNOTATION_EXPIRES  = "secrets.fireflycons.io/expires"
 	ANNOTATION_LIFETIME = "secrets.fireflycons.io/validity"
+	ANNOTATION_ORPHANED = "secrets.fireflycons.io/orphaned"
+	ANNOTATION_LAYOUT   = "secrets.fireflycons.io/layout"
+)
+
+// Label on the secrets the operator generates, so the secret protection webhook is only
+// called for those. Removed when a secret is retained, as it then belongs to its user.
+const (
+	LABEL_MANAGED = "secrets.fireflycons.io/managed"
+	MANAGED       = "true"
+)
+
+const (
+	ERROR_FMT_MAX_AGE        = "maxAge %v exceeds token lifetime %v"
+	ERROR_FMT_REFRESH_BEFORE = "refreshBefore %v is not less than token lifetime %v"
 )
 
 // Compute a UUID based on a hash of the relevant secret content (expires annotation and auth data)
 // that will be used to detect changes.
+// Each data key is hashed along with its value, in key order, so that renaming a key or moving
+// content between keys is detected.
+// Where ECR auth has been merged into a user-managed secret, only the merged auths are hashed.
 func GetSecretUuid(secret *corev1.Secret) uuid.UUID {
 
-	data, ok := secret.Data[".dockerconfigjson"]
-
-	if !ok {
+	if len(secret.Data) == 0 {
 		return uuid.Nil
 	}
 
+	var data []byte
+
+	if IsMerged(secret) {
+		data = getMergedData(secret)
+
+		if data == nil {
+			return uuid.Nil
+		}
+	} else {
+		keys := make([]string, 0, len(secret.Data))
+
+		for k := range secret.Data {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			data = appendHashEntry(data, k, secret.Data[k])
+		}
+	}
+
 	expires, ok := secret.Annotations[ANNOTATION_EXPIRES]
 
 	if !ok {
@@ -66,6 +113,16 @@ func GetSecretUuid(secret *corev1.Secret) uuid.UUID {
 	return uid
 }
 
+// Append a key and its value to the content being hashed. The key is terminated and the value
+// length-prefixed, so that no two different sets of entries produce the same content.
+func appendHashEntry(data []byte, key string, value []byte) []byte {
+
+	data = append(append(data, key...), 0)
+	data = append(append(data, strconv.Itoa(len(value))...), 0)
+
+	return append(data, value...)
+}
+
 // Check if the secret should be renewed
 // It should be renewed if it has exeited for longer than maxAge
 // or if there is any kind of error parsing it
@@ -102,7 +159,62 @@ func IsExpired(secret *corev1.Secret, maxAge time.Duration, clock clock.Clock) b
 	t1 := expireTime.Add(maxAge - lifeTime)
 	now := clock.Now()
 
-	return (secret.OwnerReferences != nil && now.After(t1))
+	return ((secret.OwnerReferences != nil || IsMerged(secret)) && now.After(t1))
+}
+
+// A secret is managed by the named ECRSecret if the ECRSecret controls it,
+// or it was retained by a deleted ECRSecret and is waiting to be adopted
+func IsManagedBy(secret *corev1.Secret, ecrSecretName string) bool {
+
+	owner := metav1.GetControllerOf(secret)
+
+	if owner == nil {
+		_, orphaned := secret.Annotations[ANNOTATION_ORPHANED]
+		return orphaned
+	}
+
+	return owner.Kind == "ECRSecret" && owner.Name == ecrSecretName && strings.HasPrefix(owner.APIVersion, API_GROUP+"/")
+}
+
+// Work out the age at which the secret should be rotated, checking the requested
+// rotation window against the token lifetime recorded in the secret.
+// Where both are given, whichever of maxAge and refreshBefore falls due first applies.
+// A refreshBefore of zero is ignored. If the window does not fit within the lifetime,
+// the nearest usable age is returned along with an error describing the problem. That is
+// the lifetime where maxAge exceeds it, or maxAge alone where refreshBefore does.
+func GetRotationAge(secret *corev1.Secret, maxAge time.Duration, refreshBefore time.Duration) (time.Duration, error) {
+
+	lifetime, ok := secret.Annotations[ANNOTATION_LIFETIME]
+
+	if !ok {
+		// IsExpired deals with secrets that have no lifetime
+		return maxAge, nil
+	}
+
+	lifeTime, err := time.ParseDuration(lifetime)
+
+	if err != nil {
+		return maxAge, nil
+	}
+
+	if maxAge > lifeTime {
+		return lifeTime, fmt.Errorf(ERROR_FMT_MAX_AGE, maxAge, lifeTime)
+	}
+
+	if refreshBefore <= 0 {
+		return maxAge, nil
+	}
+
+	if refreshBefore >= lifeTime {
+		// An age of zero would rotate on every reconcile
+		return maxAge, fmt.Errorf(ERROR_FMT_REFRESH_BEFORE, refreshBefore, lifeTime)
+	}
+
+	if lifeTime-refreshBefore < maxAge {
+		return lifeTime - refreshBefore, nil
+	}
+
+	return maxAge, nil
 }
 
 // Determine if the secret has drifted from desired state by comparing value of uid anntation
@@ -133,9 +245,22 @@ func IsChanged(secret *corev1.Secret) bool {
 	return (statedUid != actualUid)
 }
 
+// Determine if the secret was generated with a different layout to the one now required
+func IsLayoutChanged(secret *corev1.Secret, layout Layout) bool {
+
+	stated, ok := secret.Annotations[ANNOTATION_LAYOUT]
+
+	if !ok {
+		// Secrets generated before layouts were introduced are all docker config json
+		stated = GetLayoutHash(Layout{})
+	}
+
+	return stated != GetLayoutHash(layout)
+}
+
 // Get the data needed to populate the secret
 // This being the annotations and the auth data iself
-func GetSecretData(ecr *aws.ECRAuthentication, clock clock.Clock) (map[string]string, map[string][]byte, error) {
+func GetSecretData(ecr *aws.ECRAuthentication, layout Layout, clock clock.Clock) (map[string]string, map[string][]byte, error) {
 
 	authData, err := (*ecr).GetAuthorizationToken()
 	if err != nil {
@@ -148,34 +273,43 @@ func GetSecretData(ecr *aws.ECRAuthentication, clock clock.Clock) (map[string]st
 		ANNOTATION_EXPIRES:  authData.ExpiresAt.Format(time.RFC3339),
 		ANNOTATION_UID:      "00000000-0000-0000-0000-000000000000",
 		ANNOTATION_LIFETIME: fmt.Sprintf("%v", validity),
+		ANNOTATION_LAYOUT:   GetLayoutHash(layout),
 	}
 
-	// Note that we don't base64 encode the payload here. APIServer will do that for us
-	data := map[string][]byte{
-		".dockerconfigjson": []byte(fmt.Sprintf("{\"auths\":{\"%s\":{\"auth\":\"%s\"}}}", *authData.ProxyEndpoint, *authData.AuthorizationToken)),
+	data, err := getPayload(authData, layout)
+
+	if err != nil {
+		return nil, nil, err
 	}
 
 	return anotations, data, nil
 }
 
 // Update a secret to desired state
-func UpdateSecret(ecr *aws.ECRAuthentication, secret *corev1.Secret, clock clock.Clock) error {
+func UpdateSecret(ecr *aws.ECRAuthentication, secret *corev1.Secret, layout Layout, clock clock.Clock) error {
 
-	annotations, data, err := GetSecretData(ecr, clock)
+	annotations, data, err := GetSecretData(ecr, layout, clock)
 
 	if err != nil {
 		return err
 	}
 
-	// Update the secret's properties first, before computing UID
-	secret.Annotations = annotations
+	// Update the secret's properties first, before computing UID.
+	// Annotations we don't own are left as they are.
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+
+	for k, v := range annotations {
+		secret.Annotations[k] = v
+	}
+
 	secret.Data = data
 
 	uid := GetSecretUuid(secret)
 
 	// Now set the UID
-	annotations[ANNOTATION_UID] = fmt.Sprintf("%v", uid)
-	secret.Annotations = annotations
+	secret.Annotations[ANNOTATION_UID] = fmt.Sprintf("%v", uid)
 
 	return nil
 }
@@ -0,0 +1,293 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ksecret
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fireflycons/ecr-secret-operator/internal/aws"
+	"github.com/fireflycons/ecr-secret-operator/internal/clock"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Annotations placed on a user-managed secret that ECR auth has been merged into
+const (
+	ANNOTATION_MERGED_REGISTRIES = "secrets.fireflycons.io/merged-registries"
+	ANNOTATION_MERGED_BY         = "secrets.fireflycons.io/merged-by"
+)
+
+const (
+	ERROR_FMT_BAD_DOCKER_CONFIG = "cannot parse docker config in secret '%s': %s"
+	ERROR_FMT_MERGE_CONFLICT    = "secret '%s' already has an auths entry for '%s' that was not merged by the operator. Remove it to allow the merge"
+)
+
+// MergeConflictError is returned by MergeSecret when the secret already has an auths entry
+// for one of our registry keys that we did not merge. Taking it over would lose the user's
+// credential when the merge is later removed.
+type MergeConflictError struct {
+	Secret   string
+	Registry string
+}
+
+func (e *MergeConflictError) Error() string {
+	return fmt.Sprintf(ERROR_FMT_MERGE_CONFLICT, e.Secret, e.Registry)
+}
+
+// Determine whether ECR auth has been merged into the secret rather than the secret being generated by us
+func IsMerged(secret *corev1.Secret) bool {
+
+	_, ok := secret.Annotations[ANNOTATION_MERGED_REGISTRIES]
+	return ok
+}
+
+// Get the registry keys in .auths that we have merged into the secret
+func getMergedRegistries(secret *corev1.Secret) []string {
+
+	registries, ok := secret.Annotations[ANNOTATION_MERGED_REGISTRIES]
+
+	if !ok || registries == "" {
+		return nil
+	}
+
+	return strings.Split(registries, ",")
+}
+
+// Parse the secret's docker config into its top level properties and its auths,
+// keeping everything we don't manage in its raw form.
+func parseDockerConfig(secret *corev1.Secret) (map[string]json.RawMessage, map[string]json.RawMessage, error) {
+
+	doc := map[string]json.RawMessage{}
+	auths := map[string]json.RawMessage{}
+
+	raw, ok := secret.Data[corev1.DockerConfigJsonKey]
+
+	if !ok || len(raw) == 0 {
+		return doc, auths, nil
+	}
+
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, nil, fmt.Errorf(ERROR_FMT_BAD_DOCKER_CONFIG, secret.Name, err.Error())
+	}
+
+	if a, ok := doc["auths"]; ok {
+		if err := json.Unmarshal(a, &auths); err != nil {
+			return nil, nil, fmt.Errorf(ERROR_FMT_BAD_DOCKER_CONFIG, secret.Name, err.Error())
+		}
+	}
+
+	return doc, auths, nil
+}
+
+// Get the registry auths from a docker config secret of either type, for adding to the docker config we generate
+func GetDockerConfigAuths(secret *corev1.Secret) (map[string]json.RawMessage, error) {
+
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		_, auths, err := parseDockerConfig(secret)
+		return auths, err
+	case corev1.SecretTypeDockercfg:
+		auths := map[string]json.RawMessage{}
+
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return nil, fmt.Errorf(ERROR_FMT_BAD_DOCKER_CONFIG, secret.Name, err.Error())
+		}
+
+		return auths, nil
+	default:
+		return nil, fmt.Errorf(ERROR_FMT_BAD_DOCKER_CONFIG, secret.Name, fmt.Sprintf("unsupported secret type '%s'", secret.Type))
+	}
+}
+
+// Write the docker config back to the secret
+func writeDockerConfig(secret *corev1.Secret, doc map[string]json.RawMessage, auths map[string]json.RawMessage) error {
+
+	a, err := json.Marshal(auths)
+
+	if err != nil {
+		return err
+	}
+
+	doc["auths"] = a
+
+	b, err := json.Marshal(doc)
+
+	if err != nil {
+		return err
+	}
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+
+	secret.Data[corev1.DockerConfigJsonKey] = b
+
+	return nil
+}
+
+// Get the content to hash for drift detection of a merged secret, which is only
+// the auths we have merged, in registry order. Returns nil if any is missing.
+func getMergedData(secret *corev1.Secret) []byte {
+
+	registries := getMergedRegistries(secret)
+
+	if len(registries) == 0 {
+		return nil
+	}
+
+	_, auths, err := parseDockerConfig(secret)
+
+	if err != nil {
+		return nil
+	}
+
+	sort.Strings(registries)
+
+	var data []byte
+
+	for _, registry := range registries {
+
+		auth, ok := auths[registry]
+
+		if !ok {
+			return nil
+		}
+
+		data = appendHashEntry(data, registry, auth)
+	}
+
+	return data
+}
+
+// Insert or update our registry auths in a user-managed docker config secret,
+// leaving the rest of the document alone.
+func MergeSecret(ecr *aws.ECRAuthentication, secret *corev1.Secret, layout Layout, clock clock.Clock) error {
+
+	annotations, data, err := GetSecretData(ecr, layout, clock)
+
+	if err != nil {
+		return err
+	}
+
+	ours := dockerConfigJson{}
+
+	if err = json.Unmarshal(data[corev1.DockerConfigJsonKey], &ours); err != nil {
+		return err
+	}
+
+	doc, auths, err := parseDockerConfig(secret)
+
+	if err != nil {
+		return err
+	}
+
+	merged := map[string]bool{}
+
+	for _, registry := range getMergedRegistries(secret) {
+		merged[registry] = true
+	}
+
+	// Never take over an entry the user put there
+	registries := make([]string, 0, len(ours.Auths))
+
+	for registry := range ours.Auths {
+		registries = append(registries, registry)
+	}
+
+	sort.Strings(registries)
+
+	for _, registry := range registries {
+		if _, ok := auths[registry]; ok && !merged[registry] {
+			return &MergeConflictError{Secret: secret.Name, Registry: registry}
+		}
+	}
+
+	// Remove anything we merged previously that is no longer ours, e.g. a dropped alias
+	for registry := range merged {
+		if _, ok := ours.Auths[registry]; !ok {
+			delete(auths, registry)
+		}
+	}
+
+	for registry, auth := range ours.Auths {
+
+		b, err := json.Marshal(auth)
+
+		if err != nil {
+			return err
+		}
+
+		auths[registry] = b
+	}
+
+	if err = writeDockerConfig(secret, doc, auths); err != nil {
+		return err
+	}
+
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+
+	for k, v := range annotations {
+		secret.Annotations[k] = v
+	}
+
+	secret.Annotations[ANNOTATION_MERGED_REGISTRIES] = strings.Join(registries, ",")
+	secret.Annotations[ANNOTATION_UID] = fmt.Sprintf("%v", GetSecretUuid(secret))
+
+	return nil
+}
+
+// Remove our registry auths and annotations from a user-managed docker config secret
+func UnmergeSecret(secret *corev1.Secret) error {
+
+	doc, auths, err := parseDockerConfig(secret)
+
+	if err != nil {
+		return err
+	}
+
+	for _, registry := range getMergedRegistries(secret) {
+		delete(auths, registry)
+	}
+
+	if err = writeDockerConfig(secret, doc, auths); err != nil {
+		return err
+	}
+
+	ReleaseMergedSecret(secret)
+
+	return nil
+}
+
+// Remove our annotations from a user-managed docker config secret, leaving our registry auths
+// in place. The secret is then no longer treated as merged, and the auths belong to the user.
+func ReleaseMergedSecret(secret *corev1.Secret) {
+
+	for _, annotation := range []string{
+		ANNOTATION_UID,
+		ANNOTATION_EXPIRES,
+		ANNOTATION_LIFETIME,
+		ANNOTATION_LAYOUT,
+		ANNOTATION_MERGED_REGISTRIES,
+		ANNOTATION_MERGED_BY,
+	} {
+		delete(secret.Annotations, annotation)
+	}
+}
@@ -0,0 +1,467 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ksecret
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	b64 "encoding/base64"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Payload formats
+const (
+	FORMAT_DOCKERCONFIGJSON = "DockerConfigJson"
+	FORMAT_OPAQUE           = "Opaque"
+	FORMAT_DOCKERCONFIGFILE = "DockerConfigFile"
+	FORMAT_ARGOCD           = "ArgoCD"
+	FORMAT_FLUX             = "Flux"
+	FORMAT_TEKTON           = "Tekton"
+	FORMAT_JENKINS          = "Jenkins"
+)
+
+// Jenkins Kubernetes Credentials Provider finds credentials by this label
+const (
+	LABEL_JENKINS_CREDENTIALS_TYPE       = "jenkins.io/credentials-type"
+	ANNOTATION_JENKINS_DESCRIPTION       = "jenkins.io/credentials-description"
+	JENKINS_CREDENTIALS_USERNAMEPASSWORD = "usernamePassword"
+)
+
+// Tekton credential initialization matches registries by annotations with this prefix,
+// suffixed with an index
+const ANNOTATION_TEKTON_DOCKER_PREFIX = "tekton.dev/docker-"
+
+// Argo CD finds repository credentials by this label
+const (
+	LABEL_ARGOCD_SECRET_TYPE = "argocd.argoproj.io/secret-type"
+	ARGOCD_REPOSITORY        = "repository"
+	ARGOCD_REPO_CREDS        = "repo-creds"
+)
+
+// Default data key for FORMAT_DOCKERCONFIGFILE, as expected by Kaniko and BuildKit
+const DEFAULT_CONFIG_KEY = "config.json"
+
+const (
+	ERROR_FMT_BAD_TOKEN = "cannot decode authorization token: %s"
+)
+
+// Describes how the auth data is laid out in the secret
+type Layout struct {
+	// ECR registry host. Not part of the layout hash since it is fixed for the life of the secret.
+	Registry string `json:"-"`
+
+	// Payload format. Empty means docker config json.
+	Format string `json:"format,omitempty"`
+
+	// Secret type for docker config formats. Empty means kubernetes.io/dockerconfigjson.
+	SecretType string `json:"secretType,omitempty"`
+
+	// Additional registry keys in docker config that map to the same credential
+	RegistryAliases []string `json:"registryAliases,omitempty"`
+
+	// Data key for FORMAT_DOCKERCONFIGFILE. Empty means config.json.
+	ConfigKey string `json:"configKey,omitempty"`
+
+	// Argo CD secret type for FORMAT_ARGOCD. Empty means repository.
+	ArgoCDSecretType string `json:"argoCDSecretType,omitempty"`
+
+	// Repository URL for FORMAT_ARGOCD. Empty means the registry host.
+	RepositoryURL string `json:"repositoryURL,omitempty"`
+
+	// Repository name for FORMAT_ARGOCD
+	RepositoryName string `json:"repositoryName,omitempty"`
+
+	// Credential description for FORMAT_JENKINS. Empty means a description naming the registry.
+	// Not part of the layout hash since it is only an annotation, so is updated in place.
+	Description string `json:"-"`
+
+	// Static registry auths from other secrets, added to docker config alongside ours.
+	// Part of the layout hash so that a change to them causes the secret to be regenerated.
+	AdditionalAuths map[string]json.RawMessage `json:"additionalAuths,omitempty"`
+}
+
+// Credential for a single registry in docker config
+type dockerAuth struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth"`
+}
+
+// Registry host to credential
+type dockerAuths map[string]dockerAuth
+
+// Content of .dockerconfigjson
+type dockerConfigJson struct {
+	Auths dockerAuths `json:"auths"`
+}
+
+// Content of .dockerconfigjson where the auths are not all ours
+type rawDockerConfigJson struct {
+	Auths map[string]json.RawMessage `json:"auths"`
+}
+
+// Fill in defaults so that equivalent layouts compare equal
+func (l Layout) normalize() Layout {
+
+	if l.Format == "" {
+		l.Format = FORMAT_DOCKERCONFIGJSON
+	}
+
+	if l.Format == FORMAT_DOCKERCONFIGJSON && l.SecretType == "" {
+		l.SecretType = string(corev1.SecretTypeDockerConfigJson)
+	}
+
+	if l.Format == FORMAT_DOCKERCONFIGFILE && l.ConfigKey == "" {
+		l.ConfigKey = DEFAULT_CONFIG_KEY
+	}
+
+	if l.Format == FORMAT_ARGOCD && l.ArgoCDSecretType == "" {
+		l.ArgoCDSecretType = ARGOCD_REPOSITORY
+	}
+
+	return l
+}
+
+// Compute a short hash of the layout, used to detect when the
+// required layout differs from the one the secret was generated with.
+func GetLayoutHash(layout Layout) string {
+
+	// Marshalling a struct of strings and string slices can not fail,
+	// and additional auths are known to be valid JSON
+	b, _ := json.Marshal(layout.normalize())
+	hash := md5.Sum(b)
+
+	return fmt.Sprintf("%x", hash[:8])
+}
+
+// Get the kubernetes secret type for the layout
+func GetSecretType(layout Layout) corev1.SecretType {
+
+	l := layout.normalize()
+
+	switch l.Format {
+	case FORMAT_OPAQUE, FORMAT_DOCKERCONFIGFILE, FORMAT_ARGOCD, FORMAT_JENKINS:
+		return corev1.SecretTypeOpaque
+	case FORMAT_FLUX:
+		return corev1.SecretTypeDockerConfigJson
+	case FORMAT_TEKTON:
+		return corev1.SecretTypeBasicAuth
+	default:
+		return corev1.SecretType(l.SecretType)
+	}
+}
+
+// Build the secret's data according to the layout
+func getPayload(authData *ecr.AuthorizationData, layout Layout) (map[string][]byte, error) {
+
+	l := layout.normalize()
+
+	switch l.Format {
+	case FORMAT_OPAQUE:
+		return getOpaquePayload(authData)
+	case FORMAT_ARGOCD:
+		return getArgoCDPayload(authData, l)
+	case FORMAT_FLUX:
+		return getFluxPayload(authData, l)
+	case FORMAT_TEKTON, FORMAT_JENKINS:
+		return getBasicAuthPayload(authData)
+	default:
+		auths, err := getDockerAuths(authData, l.RegistryAliases)
+
+		if err != nil {
+			return nil, err
+		}
+
+		all, err := addAdditionalAuths(auths, l.AdditionalAuths)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if l.Format == FORMAT_DOCKERCONFIGFILE {
+			return marshalPayload(l.ConfigKey, rawDockerConfigJson{Auths: all})
+		}
+
+		if l.SecretType == string(corev1.SecretTypeDockercfg) {
+			return marshalPayload(corev1.DockerConfigKey, all)
+		}
+
+		return marshalPayload(corev1.DockerConfigJsonKey, rawDockerConfigJson{Auths: all})
+	}
+}
+
+// Combine our auths with static auths from other secrets. Ours take precedence.
+func addAdditionalAuths(auths dockerAuths, additional map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+
+	all := map[string]json.RawMessage{}
+
+	for registry, auth := range additional {
+		all[registry] = auth
+	}
+
+	for registry, auth := range auths {
+
+		b, err := json.Marshal(auth)
+
+		if err != nil {
+			return nil, err
+		}
+
+		all[registry] = b
+	}
+
+	return all, nil
+}
+
+// Build the docker config auths for the registry and any aliases, all sharing the same credential
+func getDockerAuths(authData *ecr.AuthorizationData, aliases []string) (dockerAuths, error) {
+
+	username, password, err := decodeAuthorizationToken(*authData.AuthorizationToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	auth := dockerAuth{
+		Username: username,
+		Password: password,
+		Auth:     *authData.AuthorizationToken,
+	}
+
+	auths := dockerAuths{*authData.ProxyEndpoint: auth}
+
+	for _, alias := range aliases {
+		auths[alias] = auth
+	}
+
+	return auths, nil
+}
+
+// Serialize a docker config document as the single data item of the secret.
+// Note that we don't base64 encode the payload here. APIServer will do that for us
+func marshalPayload(key string, v interface{}) (map[string][]byte, error) {
+
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{key: b}, nil
+}
+
+// Plain username and password for consumers that don't understand docker config
+func getOpaquePayload(authData *ecr.AuthorizationData) (map[string][]byte, error) {
+
+	username, password, err := decodeAuthorizationToken(*authData.AuthorizationToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{
+		"username":  []byte(username),
+		"password":  []byte(password),
+		"registry":  []byte(registryHost(*authData.ProxyEndpoint)),
+		"expiresAt": []byte(authData.ExpiresAt.Format(time.RFC3339)),
+	}, nil
+}
+
+// Argo CD repository credential for Helm charts stored as OCI artifacts
+func getArgoCDPayload(authData *ecr.AuthorizationData, layout Layout) (map[string][]byte, error) {
+
+	username, password, err := decodeAuthorizationToken(*authData.AuthorizationToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	url := layout.RepositoryURL
+
+	if url == "" {
+		url = registryHost(*authData.ProxyEndpoint)
+	}
+
+	data := map[string][]byte{
+		"type":      []byte("helm"),
+		"url":       []byte(url),
+		"enableOCI": []byte("true"),
+		"username":  []byte(username),
+		"password":  []byte(password),
+	}
+
+	if layout.RepositoryName != "" {
+		data["name"] = []byte(layout.RepositoryName)
+	}
+
+	return data, nil
+}
+
+// Username and password as required by kubernetes.io/basic-auth and Jenkins
+func getBasicAuthPayload(authData *ecr.AuthorizationData) (map[string][]byte, error) {
+
+	username, password, err := decodeAuthorizationToken(*authData.AuthorizationToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{
+		corev1.BasicAuthUsernameKey: []byte(username),
+		corev1.BasicAuthPasswordKey: []byte(password),
+	}, nil
+}
+
+// Flux HelmRepository (type oci) and OCIRepository sources accept either docker config
+// or username and password, so provide both. Flux matches registries by bare host name.
+func getFluxPayload(authData *ecr.AuthorizationData, layout Layout) (map[string][]byte, error) {
+
+	auths, err := getDockerAuths(authData, layout.RegistryAliases)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hostAuths := dockerAuths{}
+
+	for registry, auth := range auths {
+		hostAuths[registryHost(registry)] = auth
+	}
+
+	data, err := marshalPayload(corev1.DockerConfigJsonKey, dockerConfigJson{Auths: hostAuths})
+
+	if err != nil {
+		return nil, err
+	}
+
+	auth := hostAuths[registryHost(*authData.ProxyEndpoint)]
+	data["username"] = []byte(auth.Username)
+	data["password"] = []byte(auth.Password)
+
+	return data, nil
+}
+
+// Labels and annotations that consumers of the layout use to find the secret
+func getLayoutMetadata(layout Layout) (map[string]string, map[string]string) {
+
+	l := layout.normalize()
+
+	switch l.Format {
+	case FORMAT_ARGOCD:
+		return map[string]string{LABEL_ARGOCD_SECRET_TYPE: l.ArgoCDSecretType}, nil
+	case FORMAT_TEKTON:
+		annotations := map[string]string{}
+
+		for i, registry := range append([]string{l.Registry}, l.RegistryAliases...) {
+			annotations[fmt.Sprintf("%s%d", ANNOTATION_TEKTON_DOCKER_PREFIX, i)] = "https://" + registryHost(registry)
+		}
+
+		return nil, annotations
+	case FORMAT_JENKINS:
+		description := l.Description
+
+		if description == "" {
+			description = fmt.Sprintf("ECR credentials for %s", registryHost(l.Registry))
+		}
+
+		return map[string]string{LABEL_JENKINS_CREDENTIALS_TYPE: JENKINS_CREDENTIALS_USERNAMEPASSWORD},
+			map[string]string{ANNOTATION_JENKINS_DESCRIPTION: description}
+	default:
+		return nil, nil
+	}
+}
+
+// Apply the labels and annotations required by the layout to the secret.
+// Returns true if the secret was modified.
+func ApplyLayoutMetadata(secret *corev1.Secret, layout Layout) bool {
+
+	labels, annotations := getLayoutMetadata(layout)
+
+	changed := MergeMetadata(&secret.Labels, labels)
+	changed = MergeMetadata(&secret.Annotations, annotations) || changed
+
+	return changed
+}
+
+// Remove the labels and annotations that any layout may have applied to the secret, so that
+// those required by a previous layout do not linger once it changes.
+// Follow with ApplyLayoutMetadata to restore those required by the current layout.
+func RemoveLayoutMetadata(secret *corev1.Secret) {
+
+	delete(secret.Labels, LABEL_ARGOCD_SECRET_TYPE)
+	delete(secret.Labels, LABEL_JENKINS_CREDENTIALS_TYPE)
+	delete(secret.Annotations, ANNOTATION_JENKINS_DESCRIPTION)
+
+	// Tekton indexes beyond the current registry and aliases would otherwise be left behind
+	for k := range secret.Annotations {
+		if strings.HasPrefix(k, ANNOTATION_TEKTON_DOCKER_PREFIX) {
+			delete(secret.Annotations, k)
+		}
+	}
+}
+
+// Copy entries into a label or annotation map, creating the map if necessary.
+// Entries already in the map and not in from are left alone.
+// Returns true if any entry was added or changed.
+func MergeMetadata(to *map[string]string, from map[string]string) bool {
+
+	changed := false
+
+	for k, v := range from {
+
+		if *to == nil {
+			*to = map[string]string{}
+		}
+
+		if current, ok := (*to)[k]; !ok || current != v {
+			(*to)[k] = v
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// ECR authorization tokens are base64 encoded "username:password"
+func decodeAuthorizationToken(token string) (string, string, error) {
+
+	decoded, err := b64.StdEncoding.DecodeString(token)
+
+	if err != nil {
+		return "", "", fmt.Errorf(ERROR_FMT_BAD_TOKEN, err.Error())
+	}
+
+	username, password, ok := strings.Cut(string(decoded), ":")
+
+	if !ok {
+		return "", "", fmt.Errorf(ERROR_FMT_BAD_TOKEN, "missing ':' separator")
+	}
+
+	return username, password, nil
+}
+
+// Strip the scheme from the ECR proxy endpoint, leaving the registry host name
+func registryHost(endpoint string) string {
+
+	return strings.TrimPrefix(strings.TrimPrefix(endpoint, "https://"), "http://")
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ksecret
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Annotation on a service account listing the image pull secrets the operator has added to it.
+// Only these are ever removed, so entries added by anyone else are left alone.
+const ANNOTATION_ADDED_PULL_SECRETS = "secrets.fireflycons.io/added-image-pull-secrets"
+
+// Get the image pull secrets the operator has added to the service account
+func GetAddedPullSecrets(sa *corev1.ServiceAccount) []string {
+
+	added, ok := sa.Annotations[ANNOTATION_ADDED_PULL_SECRETS]
+
+	if !ok || added == "" {
+		return nil
+	}
+
+	return strings.Split(added, ",")
+}
+
+// Record the image pull secrets the operator has added to the service account
+func SetAddedPullSecrets(sa *corev1.ServiceAccount, added []string) {
+
+	if len(added) == 0 {
+		delete(sa.Annotations, ANNOTATION_ADDED_PULL_SECRETS)
+		return
+	}
+
+	if sa.Annotations == nil {
+		sa.Annotations = map[string]string{}
+	}
+
+	sa.Annotations[ANNOTATION_ADDED_PULL_SECRETS] = strings.Join(added, ",")
+}
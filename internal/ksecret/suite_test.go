@@ -19,7 +19,10 @@ package ksecret
 
 import (
 	"crypto/md5"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"testing"
 	"time"
 
@@ -50,8 +53,31 @@ func newErrorAuthentication() aws.ECRAuthentication {
 	return &errorECRAuthentication{}
 }
 
-func makeUid(payload []byte, expiry string, lifetime string) uuid.UUID {
-	hash := md5.Sum(append(append(payload, []byte(expiry)...), []byte(lifetime)...))
+// Returns the proxy endpoint with a scheme, as the real ECR API does
+type httpsEndpointAuthentication struct {
+	aws.MockECRAuthentication
+}
+
+func (m *httpsEndpointAuthentication) GetAuthorizationToken() (*ecr.AuthorizationData, error) {
+	authData, _ := m.MockECRAuthentication.GetAuthorizationToken()
+	endpoint := "https://" + *authData.ProxyEndpoint
+	authData.ProxyEndpoint = &endpoint
+	return authData, nil
+}
+
+// Hashes the data as key, NUL, value length, NUL, value for each key in key order
+func makeUid(data map[string][]byte, expiry string, lifetime string) uuid.UUID {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var content []byte
+	for _, k := range keys {
+		content = append(content, []byte(fmt.Sprintf("%s\x00%d\x00", k, len(data[k])))...)
+		content = append(content, data[k]...)
+	}
+	hash := md5.Sum(append(append(content, []byte(expiry)...), []byte(lifetime)...))
 	uid, _ := uuid.FromBytes(hash[:])
 	return uid
 }
@@ -67,7 +93,7 @@ func prepareUpdateSecret(secret *v1.Secret) error {
 	tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
 	mockAuth := aws.NewMockAuthentication()
 
-	return UpdateSecret(&mockAuth, secret, tclock)
+	return UpdateSecret(&mockAuth, secret, Layout{}, tclock)
 }
 
 var _ = Describe("Kube Secret", func() {
@@ -75,8 +101,10 @@ var _ = Describe("Kube Secret", func() {
 	var secret *v1.Secret
 
 	var payload = []byte(
-		fmt.Sprintf(`{"auths":{"%s":{"auth":"%s"}}}`,
+		fmt.Sprintf(`{"auths":{"%s":{"username":"%s","password":"%s","auth":"%s"}}}`,
 			aws.TEST_REGISTRY,
+			aws.TEST_USER,
+			aws.TEST_PASSWORD,
 			aws.TEST_AUTH_DATA))
 
 	var payloadEncoded = []byte(b64.StdEncoding.EncodeToString(payload))
@@ -105,13 +133,19 @@ var _ = Describe("Kube Secret", func() {
 
 		It("Should set correct UUID", func() {
 			_ = prepareUpdateSecret(secret)
-			Expect(uuid.MustParse(secret.Annotations[ANNOTATION_UID])).To(Equal(makeUid(payload, aws.TEST_EXPIRY, aws.VALID_LIFETIME)))
+			Expect(uuid.MustParse(secret.Annotations[ANNOTATION_UID])).To(Equal(makeUid(map[string][]byte{".dockerconfigjson": payload}, aws.TEST_EXPIRY, aws.VALID_LIFETIME)))
+		})
+
+		It("Should preserve annotations it does not own", func() {
+			secret.Annotations = map[string]string{"example.com/owner": "someone"}
+			_ = prepareUpdateSecret(secret)
+			Expect(secret.Annotations["example.com/owner"]).To(Equal("someone"))
 		})
 
 		It("Should error if error returned by AWS", func() {
 			mockAuth := newErrorAuthentication()
 			clock := clock.TestClock{}
-			err := UpdateSecret(&mockAuth, secret, clock)
+			err := UpdateSecret(&mockAuth, secret, Layout{}, clock)
 
 			Expect(err).To(HaveOccurred())
 		})
@@ -125,7 +159,7 @@ var _ = Describe("Kube Secret", func() {
 			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
 			mockAuth := aws.NewMockAuthentication()
 
-			a, _, _ := GetSecretData(&mockAuth, tclock)
+			a, _, _ := GetSecretData(&mockAuth, Layout{}, tclock)
 
 			Expect(a[ANNOTATION_EXPIRES]).To(Equal(aws.TEST_EXPIRY))
 		})
@@ -135,7 +169,7 @@ var _ = Describe("Kube Secret", func() {
 			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
 			mockAuth := aws.NewMockAuthentication()
 
-			a, _, _ := GetSecretData(&mockAuth, tclock)
+			a, _, _ := GetSecretData(&mockAuth, Layout{}, tclock)
 
 			Expect(a[ANNOTATION_LIFETIME]).To(Equal(aws.VALID_LIFETIME))
 		})
@@ -145,7 +179,7 @@ var _ = Describe("Kube Secret", func() {
 			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
 			mockAuth := aws.NewMockAuthentication()
 
-			a, _, _ := GetSecretData(&mockAuth, tclock)
+			a, _, _ := GetSecretData(&mockAuth, Layout{}, tclock)
 
 			Expect(a[ANNOTATION_UID]).To(Equal(fmt.Sprintf("%v", uuid.Nil)))
 		})
@@ -155,7 +189,7 @@ var _ = Describe("Kube Secret", func() {
 			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
 			mockAuth := aws.NewMockAuthentication()
 
-			_, d, _ := GetSecretData(&mockAuth, tclock)
+			_, d, _ := GetSecretData(&mockAuth, Layout{}, tclock)
 
 			Expect(d[".dockerconfigjson"]).To(Equal(payload))
 		})
@@ -163,12 +197,535 @@ var _ = Describe("Kube Secret", func() {
 		It("Should error if error returned by AWS", func() {
 			mockAuth := newErrorAuthentication()
 			tclock := clock.TestClock{}
-			_, _, err := GetSecretData(&mockAuth, tclock)
+			_, _, err := GetSecretData(&mockAuth, Layout{}, tclock)
+
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Opaque Format", func() {
+
+		var data map[string][]byte
+
+		BeforeEach(func() {
+			tclock := clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			mockAuth := aws.NewMockAuthentication()
+
+			_, data, _ = GetSecretData(&mockAuth, Layout{Format: FORMAT_OPAQUE}, tclock)
+		})
+
+		It("Should be an opaque secret", func() {
+			Expect(GetSecretType(Layout{Format: FORMAT_OPAQUE})).To(Equal(v1.SecretTypeOpaque))
+		})
+
+		It("Should get username", func() {
+			Expect(data["username"]).To(Equal([]byte(aws.TEST_USER)))
+		})
+
+		It("Should get password", func() {
+			Expect(data["password"]).To(Equal([]byte(aws.TEST_PASSWORD)))
+		})
+
+		It("Should get registry", func() {
+			Expect(data["registry"]).To(Equal([]byte(aws.TEST_REGISTRY)))
+		})
+
+		It("Should get expiry", func() {
+			Expect(data["expiresAt"]).To(Equal([]byte(aws.TEST_EXPIRY)))
+		})
+
+		It("Should not have docker config", func() {
+			Expect(data).NotTo(HaveKey(".dockerconfigjson"))
+		})
+	})
+
+	Context("Registry Aliases", func() {
+
+		It("Should map every alias to the same credential", func() {
+			tclock := clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			mockAuth := aws.NewMockAuthentication()
+			alias := "registry.example.com"
+
+			_, d, _ := GetSecretData(&mockAuth, Layout{RegistryAliases: []string{alias}}, tclock)
+
+			config := map[string]map[string]map[string]string{}
+			Expect(json.Unmarshal(d[".dockerconfigjson"], &config)).To(Succeed())
+			Expect(config["auths"]).To(HaveLen(2))
+			Expect(config["auths"][alias]).To(Equal(config["auths"][aws.TEST_REGISTRY]))
+			Expect(config["auths"][alias]["username"]).To(Equal(aws.TEST_USER))
+			Expect(config["auths"][alias]["password"]).To(Equal(aws.TEST_PASSWORD))
+			Expect(config["auths"][alias]["auth"]).To(Equal(aws.TEST_AUTH_DATA))
+		})
+
+		It("Layout differs when aliases are added", func() {
+			Expect(GetLayoutHash(Layout{RegistryAliases: []string{"registry.example.com"}})).NotTo(Equal(GetLayoutHash(Layout{})))
+		})
+	})
+
+	Context("Docker Config File Format", func() {
+
+		var tclock clock.TestClock
+		var mockAuth aws.ECRAuthentication
+
+		BeforeEach(func() {
+			tclock = clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			mockAuth = aws.NewMockAuthentication()
+		})
+
+		It("Should be an opaque secret", func() {
+			Expect(GetSecretType(Layout{Format: FORMAT_DOCKERCONFIGFILE})).To(Equal(v1.SecretTypeOpaque))
+		})
+
+		It("Should write docker config under config.json by default", func() {
+			_, d, _ := GetSecretData(&mockAuth, Layout{Format: FORMAT_DOCKERCONFIGFILE}, tclock)
+
+			Expect(d).To(HaveLen(1))
+			Expect(d[DEFAULT_CONFIG_KEY]).To(Equal(payload))
+		})
+
+		It("Should write docker config under given key", func() {
+			_, d, _ := GetSecretData(&mockAuth, Layout{Format: FORMAT_DOCKERCONFIGFILE, ConfigKey: "auth.json"}, tclock)
+
+			Expect(d).To(HaveLen(1))
+			Expect(d["auth.json"]).To(Equal(payload))
+		})
+	})
+
+	Context("Argo CD Format", func() {
+
+		var tclock clock.TestClock
+		var mockAuth aws.ECRAuthentication
+
+		BeforeEach(func() {
+			tclock = clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			mockAuth = aws.NewMockAuthentication()
+		})
+
+		It("Should render helm OCI repository", func() {
+			_, d, _ := GetSecretData(&mockAuth, Layout{Format: FORMAT_ARGOCD}, tclock)
+
+			Expect(d["type"]).To(Equal([]byte("helm")))
+			Expect(d["enableOCI"]).To(Equal([]byte("true")))
+			Expect(d["url"]).To(Equal([]byte(aws.TEST_REGISTRY)))
+			Expect(d["username"]).To(Equal([]byte(aws.TEST_USER)))
+			Expect(d["password"]).To(Equal([]byte(aws.TEST_PASSWORD)))
+			Expect(d).NotTo(HaveKey("name"))
+		})
+
+		It("Should use given url and name", func() {
+			_, d, _ := GetSecretData(&mockAuth, Layout{Format: FORMAT_ARGOCD, RepositoryURL: "registry.example.com/charts", RepositoryName: "charts"}, tclock)
+
+			Expect(d["url"]).To(Equal([]byte("registry.example.com/charts")))
+			Expect(d["name"]).To(Equal([]byte("charts")))
+		})
+
+		It("Should label secret as repository by default", func() {
+			Expect(ApplyLayoutMetadata(secret, Layout{Format: FORMAT_ARGOCD})).To(BeTrue())
+			Expect(secret.Labels).To(HaveKeyWithValue(LABEL_ARGOCD_SECRET_TYPE, ARGOCD_REPOSITORY))
+		})
+
+		It("Should label secret as repo-creds when requested", func() {
+			Expect(ApplyLayoutMetadata(secret, Layout{Format: FORMAT_ARGOCD, ArgoCDSecretType: ARGOCD_REPO_CREDS})).To(BeTrue())
+			Expect(secret.Labels).To(HaveKeyWithValue(LABEL_ARGOCD_SECRET_TYPE, ARGOCD_REPO_CREDS))
+		})
+
+		It("Should not report change when label already present", func() {
+			secret.Labels = map[string]string{LABEL_ARGOCD_SECRET_TYPE: ARGOCD_REPOSITORY, "other": "label"}
+			Expect(ApplyLayoutMetadata(secret, Layout{Format: FORMAT_ARGOCD})).To(BeFalse())
+			Expect(secret.Labels).To(HaveKey("other"))
+		})
+
+		It("Should remove label when format changes", func() {
+			ApplyLayoutMetadata(secret, Layout{Format: FORMAT_ARGOCD})
+			secret.Labels["other"] = "label"
+
+			RemoveLayoutMetadata(secret)
+			ApplyLayoutMetadata(secret, Layout{Format: FORMAT_OPAQUE})
+
+			Expect(secret.Labels).NotTo(HaveKey(LABEL_ARGOCD_SECRET_TYPE))
+			Expect(secret.Labels).To(HaveKey("other"))
+		})
+	})
+
+	Context("Flux Format", func() {
+
+		var d map[string][]byte
+
+		BeforeEach(func() {
+			tclock := clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			var mockAuth aws.ECRAuthentication = &httpsEndpointAuthentication{}
+
+			_, d, _ = GetSecretData(&mockAuth, Layout{Format: FORMAT_FLUX, RegistryAliases: []string{"https://registry.example.com"}}, tclock)
+		})
+
+		It("Should be a docker config json secret", func() {
+			Expect(GetSecretType(Layout{Format: FORMAT_FLUX})).To(Equal(v1.SecretTypeDockerConfigJson))
+		})
+
+		It("Should key docker config by bare host", func() {
+			config := map[string]map[string]map[string]string{}
+			Expect(json.Unmarshal(d[".dockerconfigjson"], &config)).To(Succeed())
+			Expect(config["auths"]).To(HaveKey(aws.TEST_REGISTRY))
+			Expect(config["auths"]).To(HaveKey("registry.example.com"))
+			Expect(config["auths"]).To(HaveLen(2))
+		})
+
+		It("Should have username and password", func() {
+			Expect(d["username"]).To(Equal([]byte(aws.TEST_USER)))
+			Expect(d["password"]).To(Equal([]byte(aws.TEST_PASSWORD)))
+		})
+	})
+
+	Context("Tekton Format", func() {
+
+		layout := Layout{Format: FORMAT_TEKTON, Registry: aws.TEST_REGISTRY, RegistryAliases: []string{"registry.example.com"}}
+
+		It("Should be a basic auth secret", func() {
+			Expect(GetSecretType(layout)).To(Equal(v1.SecretTypeBasicAuth))
+		})
+
+		It("Should have username and password", func() {
+			tclock := clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			mockAuth := aws.NewMockAuthentication()
+
+			_, d, _ := GetSecretData(&mockAuth, layout, tclock)
+
+			Expect(d[v1.BasicAuthUsernameKey]).To(Equal([]byte(aws.TEST_USER)))
+			Expect(d[v1.BasicAuthPasswordKey]).To(Equal([]byte(aws.TEST_PASSWORD)))
+		})
+
+		It("Should annotate registry and aliases", func() {
+			ApplyLayoutMetadata(secret, layout)
+
+			Expect(secret.Annotations).To(HaveKeyWithValue("tekton.dev/docker-0", "https://"+aws.TEST_REGISTRY))
+			Expect(secret.Annotations).To(HaveKeyWithValue("tekton.dev/docker-1", "https://registry.example.com"))
+		})
+
+		It("Should keep annotations through update", func() {
+			tclock := clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			mockAuth := aws.NewMockAuthentication()
+
+			ApplyLayoutMetadata(secret, layout)
+			Expect(UpdateSecret(&mockAuth, secret, layout, tclock)).To(Succeed())
+			Expect(secret.Annotations).To(HaveKeyWithValue("tekton.dev/docker-0", "https://"+aws.TEST_REGISTRY))
+		})
+
+		It("Should remove annotations for dropped aliases", func() {
+			ApplyLayoutMetadata(secret, layout)
+			secret.Annotations["other"] = "annotation"
+
+			RemoveLayoutMetadata(secret)
+			ApplyLayoutMetadata(secret, Layout{Format: FORMAT_TEKTON, Registry: aws.TEST_REGISTRY})
+
+			Expect(secret.Annotations).To(HaveKeyWithValue("tekton.dev/docker-0", "https://"+aws.TEST_REGISTRY))
+			Expect(secret.Annotations).NotTo(HaveKey("tekton.dev/docker-1"))
+			Expect(secret.Annotations).To(HaveKey("other"))
+		})
+	})
+
+	Context("Jenkins Format", func() {
+
+		layout := Layout{Format: FORMAT_JENKINS, Registry: aws.TEST_REGISTRY}
+
+		It("Should be an opaque secret", func() {
+			Expect(GetSecretType(layout)).To(Equal(v1.SecretTypeOpaque))
+		})
+
+		It("Should have username and password", func() {
+			tclock := clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			mockAuth := aws.NewMockAuthentication()
+
+			_, d, _ := GetSecretData(&mockAuth, layout, tclock)
+
+			Expect(d["username"]).To(Equal([]byte(aws.TEST_USER)))
+			Expect(d["password"]).To(Equal([]byte(aws.TEST_PASSWORD)))
+		})
+
+		It("Should label as username and password credential", func() {
+			ApplyLayoutMetadata(secret, layout)
+
+			Expect(secret.Labels).To(HaveKeyWithValue(LABEL_JENKINS_CREDENTIALS_TYPE, JENKINS_CREDENTIALS_USERNAMEPASSWORD))
+			Expect(secret.Annotations).To(HaveKeyWithValue(ANNOTATION_JENKINS_DESCRIPTION, "ECR credentials for "+aws.TEST_REGISTRY))
+		})
+
+		It("Should use given description", func() {
+			ApplyLayoutMetadata(secret, Layout{Format: FORMAT_JENKINS, Registry: aws.TEST_REGISTRY, Description: "Build registry"})
+
+			Expect(secret.Annotations).To(HaveKeyWithValue(ANNOTATION_JENKINS_DESCRIPTION, "Build registry"))
+		})
+
+		It("Should update description without changing layout", func() {
+			described := Layout{Format: FORMAT_JENKINS, Registry: aws.TEST_REGISTRY, Description: "Build registry"}
+			ApplyLayoutMetadata(secret, layout)
+
+			Expect(GetLayoutHash(described)).To(Equal(GetLayoutHash(layout)))
+			Expect(ApplyLayoutMetadata(secret, described)).To(BeTrue())
+			Expect(secret.Annotations).To(HaveKeyWithValue(ANNOTATION_JENKINS_DESCRIPTION, "Build registry"))
+		})
+	})
+
+	Context("Dockercfg Secret Type", func() {
+
+		layout := Layout{SecretType: string(v1.SecretTypeDockercfg)}
+
+		It("Should be a dockercfg secret", func() {
+			Expect(GetSecretType(layout)).To(Equal(v1.SecretTypeDockercfg))
+		})
+
+		It("Should get correct auth data payload", func() {
+			tclock := clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			mockAuth := aws.NewMockAuthentication()
+
+			_, d, _ := GetSecretData(&mockAuth, layout, tclock)
+
+			Expect(d[".dockercfg"]).To(Equal([]byte(fmt.Sprintf(`{"%s":{"username":"%s","password":"%s","auth":"%s"}}`,
+				aws.TEST_REGISTRY,
+				aws.TEST_USER,
+				aws.TEST_PASSWORD,
+				aws.TEST_AUTH_DATA))))
+			Expect(d).NotTo(HaveKey(".dockerconfigjson"))
+		})
+
+		It("Should not be detected as changed after update", func() {
+			secret.Type = v1.SecretTypeDockercfg
+			tclock := clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			mockAuth := aws.NewMockAuthentication()
 
+			Expect(UpdateSecret(&mockAuth, secret, layout, tclock)).To(Succeed())
+			Expect(IsChanged(secret)).To(BeFalse())
+		})
+
+		It("Layout differs from default", func() {
+			Expect(GetLayoutHash(layout)).NotTo(Equal(GetLayoutHash(Layout{})))
+		})
+	})
+
+	Context("Additional Auths", func() {
+
+		var tclock clock.TestClock
+		var mockAuth aws.ECRAuthentication
+		var additional = map[string]json.RawMessage{
+			"docker.io":       json.RawMessage(`{"auth":"dXNlcjpwYXNz"}`),
+			aws.TEST_REGISTRY: json.RawMessage(`{"auth":"c3RhbGU6Y3JlZHM="}`),
+		}
+
+		BeforeEach(func() {
+			tclock = clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			mockAuth = aws.NewMockAuthentication()
+		})
+
+		It("Should add the auths with ours taking precedence", func() {
+			_, d, err := GetSecretData(&mockAuth, Layout{AdditionalAuths: additional}, tclock)
+			Expect(err).NotTo(HaveOccurred())
+
+			config := map[string]map[string]map[string]string{}
+			Expect(json.Unmarshal(d[".dockerconfigjson"], &config)).To(Succeed())
+			Expect(config["auths"]).To(HaveLen(2))
+			Expect(config["auths"]["docker.io"]["auth"]).To(Equal("dXNlcjpwYXNz"))
+			Expect(config["auths"][aws.TEST_REGISTRY]["auth"]).To(Equal(aws.TEST_AUTH_DATA))
+		})
+
+		It("Should add the auths to a docker config file", func() {
+			_, d, err := GetSecretData(&mockAuth, Layout{Format: FORMAT_DOCKERCONFIGFILE, AdditionalAuths: additional}, tclock)
+			Expect(err).NotTo(HaveOccurred())
+
+			config := map[string]map[string]map[string]string{}
+			Expect(json.Unmarshal(d[DEFAULT_CONFIG_KEY], &config)).To(Succeed())
+			Expect(config["auths"]).To(HaveKey("docker.io"))
+		})
+
+		It("Layout differs when the auths change", func() {
+			changed := map[string]json.RawMessage{"docker.io": json.RawMessage(`{"auth":"bmV3OnBhc3M="}`)}
+
+			Expect(GetLayoutHash(Layout{AdditionalAuths: additional})).NotTo(Equal(GetLayoutHash(Layout{})))
+			Expect(GetLayoutHash(Layout{AdditionalAuths: additional})).NotTo(Equal(GetLayoutHash(Layout{AdditionalAuths: changed})))
+			Expect(GetLayoutHash(Layout{AdditionalAuths: map[string]json.RawMessage{}})).To(Equal(GetLayoutHash(Layout{})))
+		})
+
+		It("Should read auths from either docker config secret type", func() {
+			secret.Type = v1.SecretTypeDockerConfigJson
+			secret.Data = map[string][]byte{".dockerconfigjson": []byte(`{"auths":{"ghcr.io":{"auth":"Z2g6dG9rZW4="}}}`)}
+
+			auths, err := GetDockerConfigAuths(secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(auths).To(HaveKey("ghcr.io"))
+
+			secret.Type = v1.SecretTypeDockercfg
+			secret.Data = map[string][]byte{".dockercfg": []byte(`{"ghcr.io":{"auth":"Z2g6dG9rZW4="}}`)}
+
+			auths, err = GetDockerConfigAuths(secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(auths).To(HaveKey("ghcr.io"))
+		})
+
+		It("Should reject other secret types", func() {
+			secret.Type = v1.SecretTypeOpaque
+
+			_, err := GetDockerConfigAuths(secret)
 			Expect(err).To(HaveOccurred())
 		})
 	})
 
+	Context("Merge", func() {
+
+		var tclock clock.TestClock
+		var mockAuth aws.ECRAuthentication
+		var userConfig = []byte(`{"auths":{"docker.io":{"auth":"dXNlcjpwYXNz"}},"credsStore":"desktop"}`)
+
+		getAuths := func() map[string]json.RawMessage {
+			_, auths, err := parseDockerConfig(secret)
+			Expect(err).NotTo(HaveOccurred())
+			return auths
+		}
+
+		setAuths := func(auths map[string]json.RawMessage) {
+			doc, _, err := parseDockerConfig(secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writeDockerConfig(secret, doc, auths)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			tclock = clock.TestClock{}
+			tclock.Set(clock.MustParseTime(aws.TEST_EXPIRY).Add(-clock.MustParseDuration(aws.VALID_LIFETIME)))
+			mockAuth = aws.NewMockAuthentication()
+			secret.Type = v1.SecretTypeDockerConfigJson
+			secret.Data = map[string][]byte{".dockerconfigjson": userConfig}
+			secret.Annotations = map[string]string{"owner": "platform-team"}
+		})
+
+		It("Should add our auth and keep everything else", func() {
+			Expect(MergeSecret(&mockAuth, secret, Layout{}, tclock)).To(Succeed())
+
+			config := map[string]json.RawMessage{}
+			Expect(json.Unmarshal(secret.Data[".dockerconfigjson"], &config)).To(Succeed())
+			Expect(string(config["credsStore"])).To(Equal(`"desktop"`))
+
+			auths := map[string]map[string]string{}
+			Expect(json.Unmarshal(config["auths"], &auths)).To(Succeed())
+			Expect(auths).To(HaveLen(2))
+			Expect(auths["docker.io"]["auth"]).To(Equal("dXNlcjpwYXNz"))
+			Expect(auths[aws.TEST_REGISTRY]["auth"]).To(Equal(aws.TEST_AUTH_DATA))
+
+			Expect(IsMerged(secret)).To(BeTrue())
+			Expect(secret.Annotations).To(HaveKeyWithValue("owner", "platform-team"))
+			Expect(secret.Annotations).To(HaveKeyWithValue(ANNOTATION_MERGED_REGISTRIES, aws.TEST_REGISTRY))
+			Expect(secret.Annotations).To(HaveKeyWithValue(ANNOTATION_EXPIRES, aws.TEST_EXPIRY))
+			Expect(IsChanged(secret)).To(BeFalse())
+		})
+
+		It("Is unchanged when entries we did not merge are edited", func() {
+			Expect(MergeSecret(&mockAuth, secret, Layout{}, tclock)).To(Succeed())
+
+			auths := getAuths()
+			auths["quay.io"] = json.RawMessage(`{"auth":"b3RoZXI6cGFzcw=="}`)
+			setAuths(auths)
+
+			Expect(IsChanged(secret)).To(BeFalse())
+		})
+
+		It("Is changed when our entry is removed", func() {
+			Expect(MergeSecret(&mockAuth, secret, Layout{}, tclock)).To(Succeed())
+
+			auths := getAuths()
+			delete(auths, aws.TEST_REGISTRY)
+			setAuths(auths)
+
+			Expect(IsChanged(secret)).To(BeTrue())
+		})
+
+		It("Should drop aliases no longer in the layout", func() {
+			alias := "registry.example.com"
+			Expect(MergeSecret(&mockAuth, secret, Layout{RegistryAliases: []string{alias}}, tclock)).To(Succeed())
+			Expect(MergeSecret(&mockAuth, secret, Layout{}, tclock)).To(Succeed())
+
+			auths := getAuths()
+			Expect(auths).NotTo(HaveKey(alias))
+			Expect(auths).To(HaveKey("docker.io"))
+			Expect(auths).To(HaveKey(aws.TEST_REGISTRY))
+		})
+
+		It("Should remove only what we merged", func() {
+			Expect(MergeSecret(&mockAuth, secret, Layout{}, tclock)).To(Succeed())
+			secret.Annotations[ANNOTATION_MERGED_BY] = "ecrsecret-sample"
+			Expect(UnmergeSecret(secret)).To(Succeed())
+
+			auths := getAuths()
+			Expect(auths).To(HaveLen(1))
+			Expect(auths).To(HaveKey("docker.io"))
+			Expect(secret.Annotations).To(Equal(map[string]string{"owner": "platform-team"}))
+		})
+
+		It("Should not merge over an entry it did not add", func() {
+			auths := getAuths()
+			auths[aws.TEST_REGISTRY] = json.RawMessage(`{"auth":"dXNlcjpwYXNz"}`)
+			setAuths(auths)
+
+			err := MergeSecret(&mockAuth, secret, Layout{}, tclock)
+
+			var conflict *MergeConflictError
+			Expect(errors.As(err, &conflict)).To(BeTrue())
+			Expect(conflict.Registry).To(Equal(aws.TEST_REGISTRY))
+			Expect(IsMerged(secret)).To(BeFalse())
+			Expect(string(getAuths()[aws.TEST_REGISTRY])).To(Equal(`{"auth":"dXNlcjpwYXNz"}`))
+		})
+
+		It("Should update an entry it added", func() {
+			Expect(MergeSecret(&mockAuth, secret, Layout{}, tclock)).To(Succeed())
+			Expect(MergeSecret(&mockAuth, secret, Layout{}, tclock)).To(Succeed())
+			Expect(IsChanged(secret)).To(BeFalse())
+		})
+
+		It("Should release the secret keeping what we merged", func() {
+			Expect(MergeSecret(&mockAuth, secret, Layout{}, tclock)).To(Succeed())
+			secret.Annotations[ANNOTATION_MERGED_BY] = "ecrsecret-sample"
+			ReleaseMergedSecret(secret)
+
+			Expect(getAuths()).To(HaveKey(aws.TEST_REGISTRY))
+			Expect(IsMerged(secret)).To(BeFalse())
+			Expect(secret.Annotations).To(Equal(map[string]string{"owner": "platform-team"}))
+		})
+
+		It("Should fail on an unparseable docker config", func() {
+			secret.Data[".dockerconfigjson"] = []byte("not json")
+			Expect(MergeSecret(&mockAuth, secret, Layout{}, tclock)).NotTo(Succeed())
+		})
+	})
+
+	Context("Layout", func() {
+
+		It("Default layout is docker config json", func() {
+			Expect(GetSecretType(Layout{})).To(Equal(v1.SecretTypeDockerConfigJson))
+		})
+
+		It("Empty format is equivalent to docker config json", func() {
+			Expect(GetLayoutHash(Layout{})).To(Equal(GetLayoutHash(Layout{Format: FORMAT_DOCKERCONFIGJSON})))
+		})
+
+		It("Is unchanged if layout annotation is missing and layout is default", func() {
+			Expect(IsLayoutChanged(secret, Layout{})).To(BeFalse())
+		})
+
+		It("Is changed if layout annotation is missing and layout is not default", func() {
+			Expect(IsLayoutChanged(secret, Layout{Format: FORMAT_OPAQUE})).To(BeTrue())
+		})
+
+		It("Is unchanged if layout annotation matches", func() {
+			secret.Annotations = map[string]string{ANNOTATION_LAYOUT: GetLayoutHash(Layout{Format: FORMAT_OPAQUE})}
+			Expect(IsLayoutChanged(secret, Layout{Format: FORMAT_OPAQUE})).To(BeFalse())
+		})
+	})
+
 	Context("GetSecretUuid", func() {
 
 		It("Returns empty UUID if secret data is missing", func() {
@@ -190,7 +747,7 @@ var _ = Describe("Kube Secret", func() {
 		})
 
 		It("Computes expected UUID", func() {
-			expected := makeUid(payloadEncoded, aws.TEST_EXPIRY, aws.VALID_LIFETIME)
+			expected := makeUid(map[string][]byte{".dockerconfigjson": payloadEncoded}, aws.TEST_EXPIRY, aws.VALID_LIFETIME)
 
 			secret.Data = map[string][]byte{".dockerconfigjson": payloadEncoded}
 			secret.Annotations = map[string]string{
@@ -201,6 +758,32 @@ var _ = Describe("Kube Secret", func() {
 			Expect(GetSecretUuid(secret)).To(Equal(expected))
 		})
 
+		It("Computes expected UUID for multiple keys in key order", func() {
+			secret.Data = map[string][]byte{"username": []byte("AWS"), "password": []byte("secret")}
+			expected := makeUid(secret.Data, aws.TEST_EXPIRY, aws.VALID_LIFETIME)
+			secret.Annotations = map[string]string{
+				ANNOTATION_EXPIRES:  aws.TEST_EXPIRY,
+				ANNOTATION_LIFETIME: aws.VALID_LIFETIME,
+			}
+
+			Expect(GetSecretUuid(secret)).To(Equal(expected))
+		})
+
+		It("Differs when content moves between keys or a key is renamed", func() {
+			secret.Annotations = map[string]string{
+				ANNOTATION_EXPIRES:  aws.TEST_EXPIRY,
+				ANNOTATION_LIFETIME: aws.VALID_LIFETIME,
+			}
+
+			secret.Data = map[string][]byte{"password": []byte("secret"), "username": []byte("AWS")}
+			original := GetSecretUuid(secret)
+
+			secret.Data = map[string][]byte{"password": []byte("secretA"), "username": []byte("WS")}
+			Expect(GetSecretUuid(secret)).NotTo(Equal(original))
+
+			secret.Data = map[string][]byte{"password": []byte("secret"), "user": []byte("AWS")}
+			Expect(GetSecretUuid(secret)).NotTo(Equal(original))
+		})
 	})
 
 	Context("Secret Expiry", func() {
@@ -277,6 +860,69 @@ var _ = Describe("Kube Secret", func() {
 		})
 	})
 
+	Context("Rotation Age", func() {
+
+		BeforeEach(func() {
+			secret.ObjectMeta.Annotations = map[string]string{ANNOTATION_EXPIRES: "2023-03-01T20:00:00Z", ANNOTATION_LIFETIME: "12h"}
+		})
+
+		It("Returns max age when refresh before is not set", func() {
+
+			age, err := GetRotationAge(secret, time.Hour*4, time.Duration(0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(age).To(Equal(time.Hour * 4))
+		})
+
+		It("Returns max age when it falls due before refresh before", func() {
+
+			age, err := GetRotationAge(secret, time.Hour*4, time.Hour*2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(age).To(Equal(time.Hour * 4))
+		})
+
+		It("Returns lifetime less refresh before when it falls due before max age", func() {
+
+			age, err := GetRotationAge(secret, time.Hour*8, time.Hour*6)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(age).To(Equal(time.Hour * 6))
+		})
+
+		It("Returns max age if lifetime annotation is missing", func() {
+
+			secret.ObjectMeta.Annotations = map[string]string{ANNOTATION_EXPIRES: "2023-03-01T20:00:00Z"}
+			age, err := GetRotationAge(secret, time.Hour*4, time.Hour*10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(age).To(Equal(time.Hour * 4))
+		})
+
+		It("Errors if max age exceeds lifetime", func() {
+
+			age, err := GetRotationAge(secret, time.Hour*13, time.Duration(0))
+			Expect(err).To(HaveOccurred())
+			Expect(age).To(Equal(time.Hour * 12))
+		})
+
+		It("Errors and ignores refresh before if it is not less than lifetime", func() {
+
+			age, err := GetRotationAge(secret, time.Hour*4, time.Hour*12)
+			Expect(err).To(HaveOccurred())
+			Expect(age).To(Equal(time.Hour * 4))
+		})
+
+		It("Does not return zero when a rounded lifetime is below refresh before and max age", func() {
+
+			secret.ObjectMeta.Annotations[ANNOTATION_LIFETIME] = "11h59m"
+
+			age, err := GetRotationAge(secret, time.Hour*4, time.Hour*11+time.Minute*59)
+			Expect(err).To(HaveOccurred())
+			Expect(age).To(Equal(time.Hour * 4))
+
+			age, err = GetRotationAge(secret, time.Hour*12, time.Hour*11+time.Minute*59)
+			Expect(err).To(HaveOccurred())
+			Expect(age).To(Equal(time.Hour*11 + time.Minute*59))
+		})
+	})
+
 	Context("Secret Drift", func() {
 
 		It("Is changed if secret payload is missing", func() {
@@ -360,10 +1006,35 @@ var _ = Describe("Kube Secret", func() {
 			secret.Annotations = map[string]string{
 				ANNOTATION_EXPIRES:  aws.TEST_EXPIRY,
 				ANNOTATION_LIFETIME: aws.VALID_LIFETIME,
-				ANNOTATION_UID:      fmt.Sprintf("%v", makeUid(payloadEncoded, aws.TEST_EXPIRY, aws.VALID_LIFETIME)),
+				ANNOTATION_UID:      fmt.Sprintf("%v", makeUid(map[string][]byte{".dockerconfigjson": payloadEncoded}, aws.TEST_EXPIRY, aws.VALID_LIFETIME)),
 			}
 
 			Expect(IsChanged(secret)).To(BeFalse())
 		})
 	})
+
+	Context("Secret Template", func() {
+
+		It("Should remove keys dropped from the template and leave others alone", func() {
+			secret.Labels = map[string]string{"example.com/team": "platform"}
+
+			Expect(ApplyTemplateMetadata(secret, map[string]string{"a": "1", "b": "2"}, map[string]string{"c": "3"})).To(BeTrue())
+			Expect(secret.Labels).To(HaveKeyWithValue("a", "1"))
+			Expect(secret.Labels).To(HaveKeyWithValue("b", "2"))
+			Expect(secret.Annotations).To(HaveKeyWithValue("c", "3"))
+
+			Expect(ApplyTemplateMetadata(secret, map[string]string{"a": "1"}, nil)).To(BeTrue())
+			Expect(secret.Labels).To(HaveKeyWithValue("a", "1"))
+			Expect(secret.Labels).NotTo(HaveKey("b"))
+			Expect(secret.Annotations).NotTo(HaveKey("c"))
+			Expect(secret.Labels).To(HaveKeyWithValue("example.com/team", "platform"))
+
+			Expect(ApplyTemplateMetadata(secret, map[string]string{"a": "1"}, nil)).To(BeFalse())
+
+			Expect(ApplyTemplateMetadata(secret, nil, nil)).To(BeTrue())
+			Expect(secret.Labels).NotTo(HaveKey("a"))
+			Expect(secret.Annotations).NotTo(HaveKey(ANNOTATION_TEMPLATE_KEYS))
+			Expect(secret.Labels).To(HaveKeyWithValue("example.com/team", "platform"))
+		})
+	})
 })
@@ -0,0 +1,103 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ksecret
+
+import (
+	"encoding/json"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Records the keys the secret template applied, so that those dropped from the template can be removed
+const ANNOTATION_TEMPLATE_KEYS = "secrets.fireflycons.io/template-keys"
+
+// Keys of the labels and annotations applied by a secret template
+type templateKeys struct {
+	Labels      []string `json:"labels,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// Apply the labels and annotations of a secret template to the secret. Those applied by a previous
+// template and no longer in it are removed. Others not named in the template are left alone.
+// Returns true if the secret was modified.
+func ApplyTemplateMetadata(secret *corev1.Secret, labels map[string]string, annotations map[string]string) bool {
+
+	previous := templateKeys{}
+
+	if recorded, ok := secret.Annotations[ANNOTATION_TEMPLATE_KEYS]; ok {
+		// An unreadable record is replaced with the current keys, leaving the old ones in place
+		_ = json.Unmarshal([]byte(recorded), &previous)
+	}
+
+	changed := removeDroppedKeys(secret.Labels, previous.Labels, labels)
+	changed = removeDroppedKeys(secret.Annotations, previous.Annotations, annotations) || changed
+	changed = MergeMetadata(&secret.Labels, labels) || changed
+	changed = MergeMetadata(&secret.Annotations, annotations) || changed
+
+	current := templateKeys{
+		Labels:      sortedKeys(labels),
+		Annotations: sortedKeys(annotations),
+	}
+
+	if len(current.Labels) == 0 && len(current.Annotations) == 0 {
+		if _, ok := secret.Annotations[ANNOTATION_TEMPLATE_KEYS]; ok {
+			delete(secret.Annotations, ANNOTATION_TEMPLATE_KEYS)
+			changed = true
+		}
+
+		return changed
+	}
+
+	recorded, _ := json.Marshal(current)
+
+	return MergeMetadata(&secret.Annotations, map[string]string{ANNOTATION_TEMPLATE_KEYS: string(recorded)}) || changed
+}
+
+// Delete the keys that were applied before and are no longer wanted.
+// Returns true if any were deleted.
+func removeDroppedKeys(metadata map[string]string, applied []string, wanted map[string]string) bool {
+
+	changed := false
+
+	for _, k := range applied {
+		if _, ok := wanted[k]; ok {
+			continue
+		}
+
+		if _, ok := metadata[k]; ok {
+			delete(metadata, k)
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Keys of a map in order, so the record is stable
+func sortedKeys(m map[string]string) []string {
+
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Parsing of container image references and registry hosts
+package registry
+
+import (
+	"regexp"
+	"strings"
+)
+
+const DOCKER_HUB = "docker.io"
+
+// Matches the ECR registries accepted by the ECRSecret registry property
+var ecrRegistry = regexp.MustCompile(`^(\d{12})\.dkr\.ecr\.((?:ap|ca|eu|sa|us(?:-gov)?)-(?:east|northeast|southeast|north|south|central|west)-\d)\.amazonaws\.com$`)
+
+// FromImage gets the registry host of an image reference, following the docker convention
+// that the first path component is a host only if it looks like one.
+func FromImage(image string) string {
+
+	first, _, found := strings.Cut(image, "/")
+
+	if !found || (!strings.ContainsAny(first, ".:") && first != "localhost") {
+		return DOCKER_HUB
+	}
+
+	return strings.ToLower(first)
+}
+
+// Host gets the bare host of a registry that may be given as a URL
+func Host(registry string) string {
+
+	host := strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+
+	return strings.ToLower(host)
+}
+
+// ParseECR gets the AWS account ID and region of an ECR registry host.
+// ok is false if the host is not an ECR registry.
+func ParseECR(host string) (accountId string, region string, ok bool) {
+
+	match := ecrRegistry.FindStringSubmatch(host)
+
+	if match == nil {
+		return "", "", false
+	}
+
+	return match[1], match[2], true
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Parsing of container image references and registry hosts
+package registry
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const TEST_REGISTRY = "123456789012.dkr.ecr.us-east-1.amazonaws.com"
+
+func TestRegistry(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Registry Suite")
+}
+
+var _ = Describe("Registry", func() {
+
+	Context("FromImage", func() {
+
+		DescribeTable("Should find the registry of an image",
+			func(image, expected string) {
+				Expect(FromImage(image)).To(Equal(expected))
+			},
+			Entry("bare name", "nginx", DOCKER_HUB),
+			Entry("docker hub user", "library/nginx:1.25", DOCKER_HUB),
+			Entry("ecr", TEST_REGISTRY+"/app:latest", TEST_REGISTRY),
+			Entry("ecr with digest", TEST_REGISTRY+"/team/app@sha256:abcd", TEST_REGISTRY),
+			Entry("host with port", "registry:5000/app", "registry:5000"),
+			Entry("localhost", "localhost/app", "localhost"),
+		)
+	})
+
+	Context("Host", func() {
+
+		It("Should strip the scheme and path", func() {
+			Expect(Host("https://ECR.example.com/v2/")).To(Equal("ecr.example.com"))
+		})
+	})
+
+	Context("ParseECR", func() {
+
+		It("Should get the account and region of an ECR registry", func() {
+			accountId, region, ok := ParseECR(TEST_REGISTRY)
+
+			Expect(ok).To(BeTrue())
+			Expect(accountId).To(Equal("123456789012"))
+			Expect(region).To(Equal("us-east-1"))
+		})
+
+		It("Should get the region of a GovCloud registry", func() {
+			_, region, ok := ParseECR("123456789012.dkr.ecr.us-gov-west-1.amazonaws.com")
+
+			Expect(ok).To(BeTrue())
+			Expect(region).To(Equal("us-gov-west-1"))
+		})
+
+		DescribeTable("Should reject registries that are not ECR",
+			func(host string) {
+				_, _, ok := ParseECR(host)
+				Expect(ok).To(BeFalse())
+			},
+			Entry("docker hub", DOCKER_HUB),
+			Entry("public ecr", "public.ecr.aws"),
+			Entry("short account", "12345.dkr.ecr.us-east-1.amazonaws.com"),
+		)
+	})
+})
@@ -0,0 +1,364 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Admission webhooks for core types
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	"github.com/fireflycons/ecr-secret-operator/internal/config"
+	"github.com/fireflycons/ecr-secret-operator/internal/ksecret"
+	"github.com/fireflycons/ecr-secret-operator/internal/registry"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// Annotation on a namespace restricting the AWS accounts its ECRSecrets may use.
+// The value is a comma separated list of account IDs.
+const ANNOTATION_ALLOWED_ACCOUNTS = "secrets.fireflycons.io/allowed-accounts"
+
+const (
+	ERROR_FMT_NO_CREDENTIALS      = "no credentials are configured for AWS account '%s'"
+	ERROR_FMT_ACCOUNT_NOT_ALLOWED = "AWS account '%s' is not allowed in namespace '%s'"
+	ERROR_FMT_ECRSECRET_COLLISION = "secret '%s' is already generated by ECRSecret '%s'"
+	ERROR_FMT_SECRET_COLLISION    = "secret '%s' already exists and is not managed by this ECRSecret"
+	ERROR_FMT_SECRET_IN_USE       = "secret '%s' is referenced by %d pod(s) and %d service account(s). Remove the references, or set the annotation %s=true to delete anyway"
+)
+
+var validatorLog = logf.Log.WithName("ecrsecret-validator")
+
+//+kubebuilder:webhook:path=/validate-secrets-fireflycons-io-v1-ecrsecret,mutating=false,failurePolicy=fail,sideEffects=None,groups=secrets.fireflycons.io,resources=ecrsecrets,verbs=create;update;delete,versions=v1,name=vecrsecret.secrets.fireflycons.io,admissionReviewVersions=v1
+
+// ECRSecretValidator checks that an ECRSecret can be reconciled, and is allowed in its namespace.
+// It also guards against deleting an ECRSecret whose secret is still in use.
+type ECRSecretValidator struct {
+	Client     client.Client
+	ConfigFile string
+	// User name of the operator's service account, whose deletes are not guarded
+	OperatorUsername string
+}
+
+var _ admission.CustomValidator = &ECRSecretValidator{}
+
+// ValidateCreate validates a new ECRSecret
+func (v *ECRSecretValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+
+	ecrSecret, ok := obj.(*secretsv1.ECRSecret)
+
+	if !ok {
+		return apierrs.NewBadRequest(fmt.Sprintf("expected an ECRSecret but got a %T", obj))
+	}
+
+	return v.validate(ctx, nil, ecrSecret)
+}
+
+// ValidateUpdate validates a change to an ECRSecret
+func (v *ECRSecretValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+
+	oldSecret, ok1 := oldObj.(*secretsv1.ECRSecret)
+	newSecret, ok2 := newObj.(*secretsv1.ECRSecret)
+
+	if !ok1 || !ok2 {
+		return apierrs.NewBadRequest(fmt.Sprintf("expected an ECRSecret but got a %T", newObj))
+	}
+
+	// Never get in the way of removing the finalizer
+	if !newSecret.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	return v.validate(ctx, oldSecret, newSecret)
+}
+
+// ValidateDelete refuses to delete an ECRSecret while pods or service accounts reference its
+// secret, unless forced. Deleting the ECRSecret deletes the secret or stops its rotation, so
+// the pods would soon fail to pull images.
+//
+// The operator's own deletes are allowed. It deletes the ECRSecrets of namespaces a ClusterECRSecret
+// no longer selects, and discovered ECRSecrets that are no longer used, and refusing those would
+// hold up the rest of the reconcile.
+func (v *ECRSecretValidator) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+
+	ecrSecret, ok := obj.(*secretsv1.ECRSecret)
+
+	if !ok {
+		return apierrs.NewBadRequest(fmt.Sprintf("expected an ECRSecret but got a %T", obj))
+	}
+
+	if req, err := admission.RequestFromContext(ctx); err == nil && v.OperatorUsername != "" && req.UserInfo.Username == v.OperatorUsername {
+		return nil
+	}
+
+	if ecrSecret.Annotations[secretsv1.AnnotationForceDelete] == "true" {
+		validatorLog.Info("Forced deletion of ECRSecret", "namespace", ecrSecret.Namespace, "ECRSecret", ecrSecret.Name)
+		return nil
+	}
+
+	namespace := corev1.Namespace{}
+
+	if err := v.Client.Get(ctx, types.NamespacedName{Name: ecrSecret.Namespace}, &namespace); err != nil {
+		return apierrs.NewInternalError(err)
+	}
+
+	// Everything in the namespace is going
+	if !namespace.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	pods, serviceAccounts, err := v.countReferences(ctx, ecrSecret.Namespace, ecrSecret.KubeSecretName())
+
+	if err != nil {
+		return apierrs.NewInternalError(err)
+	}
+
+	if pods == 0 && serviceAccounts == 0 {
+		return nil
+	}
+
+	return apierrs.NewForbidden(
+		secretsv1.GroupVersion.WithResource("ecrsecrets").GroupResource(),
+		ecrSecret.Name,
+		fmt.Errorf(ERROR_FMT_SECRET_IN_USE, ecrSecret.KubeSecretName(), pods, serviceAccounts, secretsv1.AnnotationForceDelete),
+	)
+}
+
+// Count the active pods and the service accounts that have the secret as an image pull secret.
+// References the operator added through spec.serviceAccounts are removed when the ECRSecret
+// is deleted, so are not counted.
+func (v *ECRSecretValidator) countReferences(ctx context.Context, namespace, secretName string) (int, int, error) {
+
+	podList := corev1.PodList{}
+
+	if err := v.Client.List(ctx, &podList, client.InNamespace(namespace)); err != nil {
+		return 0, 0, err
+	}
+
+	pods := 0
+
+	for i := range podList.Items {
+
+		pod := &podList.Items[i]
+
+		if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed && hasPullSecret(pod.Spec.ImagePullSecrets, secretName) {
+			pods++
+		}
+	}
+
+	serviceAccountList := corev1.ServiceAccountList{}
+
+	if err := v.Client.List(ctx, &serviceAccountList, client.InNamespace(namespace)); err != nil {
+		return 0, 0, err
+	}
+
+	serviceAccounts := 0
+
+	for i := range serviceAccountList.Items {
+
+		sa := &serviceAccountList.Items[i]
+
+		if hasPullSecret(sa.ImagePullSecrets, secretName) && !isAddedByOperator(sa, secretName) {
+			serviceAccounts++
+		}
+	}
+
+	return pods, serviceAccounts, nil
+}
+
+func hasPullSecret(refs []corev1.LocalObjectReference, secretName string) bool {
+
+	for _, ref := range refs {
+		if ref.Name == secretName {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isAddedByOperator(sa *corev1.ServiceAccount, secretName string) bool {
+
+	for _, name := range ksecret.GetAddedPullSecrets(sa) {
+		if name == secretName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate the ECRSecret. On update only the fields that have changed are checked, so that
+// a change to the operator's configuration or the namespace does not stop existing
+// ECRSecrets from being updated.
+func (v *ECRSecretValidator) validate(ctx context.Context, oldSecret, ecrSecret *secretsv1.ECRSecret) error {
+
+	var errs field.ErrorList
+
+	specPath := field.NewPath("spec")
+
+	if oldSecret == nil || oldSecret.Spec.Registry != ecrSecret.Spec.Registry {
+
+		fieldErrs, err := v.validateRegistry(ctx, ecrSecret, specPath.Child("registry"))
+
+		if err != nil {
+			return apierrs.NewInternalError(err)
+		}
+
+		errs = append(errs, fieldErrs...)
+	}
+
+	if oldSecret == nil || oldSecret.KubeSecretName() != ecrSecret.KubeSecretName() || oldSecret.Spec.Merge != ecrSecret.Spec.Merge {
+
+		fieldErr, err := v.validateSecretName(ctx, ecrSecret, specPath.Child("secretName"))
+
+		if err != nil {
+			return apierrs.NewInternalError(err)
+		}
+
+		if fieldErr != nil {
+			errs = append(errs, fieldErr)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return apierrs.NewInvalid(secretsv1.GroupVersion.WithKind("ECRSecret").GroupKind(), ecrSecret.Name, errs)
+}
+
+// The registry's account must have credentials, and be allowed in the namespace
+func (v *ECRSecretValidator) validateRegistry(ctx context.Context, ecrSecret *secretsv1.ECRSecret, path *field.Path) (field.ErrorList, error) {
+
+	accountId, _, ok := registry.ParseECR(ecrSecret.Spec.Registry)
+
+	if !ok {
+		// The CRD pattern reports this
+		return nil, nil
+	}
+
+	var errs field.ErrorList
+
+	configured, err := v.hasCredentials(accountId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !configured {
+		errs = append(errs, field.Invalid(path, ecrSecret.Spec.Registry, fmt.Sprintf(ERROR_FMT_NO_CREDENTIALS, accountId)))
+	}
+
+	namespace := corev1.Namespace{}
+
+	if err := v.Client.Get(ctx, types.NamespacedName{Name: ecrSecret.Namespace}, &namespace); err != nil {
+		return nil, err
+	}
+
+	if allowed, restricted := namespace.Annotations[ANNOTATION_ALLOWED_ACCOUNTS]; restricted && !isAccountAllowed(allowed, accountId) {
+		errs = append(errs, field.Forbidden(path, fmt.Sprintf(ERROR_FMT_ACCOUNT_NOT_ALLOWED, accountId, ecrSecret.Namespace)))
+	}
+
+	return errs, nil
+}
+
+func (v *ECRSecretValidator) hasCredentials(accountId string) (bool, error) {
+
+	configStream, err := os.Open(v.ConfigFile)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer configStream.Close()
+
+	accounts, err := config.LoadAccounts(configStream)
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, account := range accounts {
+		if account == accountId {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func isAccountAllowed(allowed string, accountId string) bool {
+
+	for _, account := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(account) == accountId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The generated secret must not be generated by another ECRSecret, nor overwrite a secret that
+// the operator does not manage. Merging is into a user-managed secret, so only the first applies.
+func (v *ECRSecretValidator) validateSecretName(ctx context.Context, ecrSecret *secretsv1.ECRSecret, path *field.Path) (*field.Error, error) {
+
+	secretName := ecrSecret.KubeSecretName()
+
+	ecrSecrets := secretsv1.ECRSecretList{}
+
+	if err := v.Client.List(ctx, &ecrSecrets, client.InNamespace(ecrSecret.Namespace)); err != nil {
+		return nil, err
+	}
+
+	for i := range ecrSecrets.Items {
+
+		other := &ecrSecrets.Items[i]
+
+		if other.Name != ecrSecret.Name && other.KubeSecretName() == secretName {
+			return field.Invalid(path, secretName, fmt.Sprintf(ERROR_FMT_ECRSECRET_COLLISION, secretName, other.Name)), nil
+		}
+	}
+
+	if ecrSecret.Spec.Merge {
+		return nil, nil
+	}
+
+	secret := corev1.Secret{}
+
+	if err := v.Client.Get(ctx, types.NamespacedName{Name: secretName, Namespace: ecrSecret.Namespace}, &secret); err != nil {
+		if apierrs.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if !ksecret.IsManagedBy(&secret, ecrSecret.Name) {
+		return field.Forbidden(path, fmt.Sprintf(ERROR_FMT_SECRET_COLLISION, secretName)), nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Admission webhooks for core types
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	"github.com/fireflycons/ecr-secret-operator/internal/registry"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// Path the pod pull secret webhook is served on
+const POD_PULL_SECRETS_PATH = "/mutate-v1-pod"
+
+// Namespaces opt in to pull secret injection with this label
+const (
+	LABEL_INJECT_PULL_SECRETS = "secrets.fireflycons.io/inject-pull-secrets"
+	INJECT_ENABLED            = "enabled"
+	INJECT_DRY_RUN            = "dry-run"
+)
+
+var podLog = logf.Log.WithName("pod-pull-secrets")
+
+//+kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=mpod.secrets.fireflycons.io,admissionReviewVersions=v1
+
+// PodPullSecretInjector adds the secrets of ECRSecrets in the pod's namespace to the pod's
+// image pull secrets, where the pod has a container image on the ECRSecret's registry.
+type PodPullSecretInjector struct {
+	Client client.Client
+	// Log what would be injected without changing the pod, in every namespace
+	DryRun  bool
+	decoder *admission.Decoder
+}
+
+// InjectDecoder injects the decoder
+func (p *PodPullSecretInjector) InjectDecoder(d *admission.Decoder) error {
+	p.decoder = d
+	return nil
+}
+
+// Handle adds any missing pull secrets to the pod
+func (p *PodPullSecretInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
+
+	namespace := corev1.Namespace{}
+
+	if err := p.Client.Get(ctx, types.NamespacedName{Name: req.Namespace}, &namespace); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	mode := namespace.Labels[LABEL_INJECT_PULL_SECRETS]
+
+	if mode != INJECT_ENABLED && mode != INJECT_DRY_RUN {
+		return admission.Allowed("namespace has not opted in to pull secret injection")
+	}
+
+	pod := &corev1.Pod{}
+
+	if err := p.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	ecrSecrets := secretsv1.ECRSecretList{}
+
+	if err := p.Client.List(ctx, &ecrSecrets, client.InNamespace(req.Namespace)); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	missing := getMissingPullSecrets(pod, ecrSecrets.Items)
+
+	if len(missing) == 0 {
+		return admission.Allowed("no pull secrets to inject")
+	}
+
+	if p.DryRun || mode == INJECT_DRY_RUN {
+		podLog.Info("Dry run. Would inject pull secrets", "namespace", req.Namespace, "pod", podName(pod), "secrets", missing)
+		return admission.Allowed("dry run").WithWarnings(fmt.Sprintf("ecr-secret-operator would add image pull secrets: %s", strings.Join(missing, ", ")))
+	}
+
+	for _, name := range missing {
+		pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+	}
+
+	marshaledPod, err := json.Marshal(pod)
+
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	podLog.V(5).Info("Injecting pull secrets", "namespace", req.Namespace, "pod", podName(pod), "secrets", missing)
+
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+}
+
+// Get the names of the secrets of ECRSecrets whose registry is used by the pod,
+// that the pod does not already reference
+func getMissingPullSecrets(pod *corev1.Pod, ecrSecrets []secretsv1.ECRSecret) []string {
+
+	hosts := map[string]bool{}
+
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			hosts[registry.FromImage(container.Image)] = true
+		}
+	}
+
+	existing := map[string]bool{}
+
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		existing[ref.Name] = true
+	}
+
+	var missing []string
+
+	for i := range ecrSecrets {
+
+		ecrSecret := &ecrSecrets[i]
+
+		if !ecrSecret.DeletionTimestamp.IsZero() || !isPullSecret(ecrSecret) {
+			continue
+		}
+
+		name := ecrSecret.KubeSecretName()
+
+		if existing[name] {
+			continue
+		}
+
+		for _, r := range ecrSecret.Registries() {
+			if hosts[registry.Host(r)] {
+				missing = append(missing, name)
+				existing[name] = true
+				break
+			}
+		}
+	}
+
+	sort.Strings(missing)
+
+	return missing
+}
+
+// Determine whether the ECRSecret's secret can be used as an image pull secret
+func isPullSecret(ecrSecret *secretsv1.ECRSecret) bool {
+
+	switch ecrSecret.Spec.Format {
+	case "", secretsv1.SecretFormatDockerConfigJson, secretsv1.SecretFormatFlux:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pods created by controllers only have a generate name at admission
+func podName(pod *corev1.Pod) string {
+
+	if pod.Name != "" {
+		return pod.Name
+	}
+
+	return pod.GenerateName
+}
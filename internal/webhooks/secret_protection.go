@@ -0,0 +1,133 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Admission webhooks for core types
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/fireflycons/ecr-secret-operator/internal/ksecret"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// Path the secret protection webhook is served on
+const SECRET_PROTECTION_PATH = "/validate-v1-secret"
+
+// Users of the Kubernetes controllers that delete secrets on behalf of the operator,
+// when an owning ECRSecret or the namespace is deleted
+var systemUsers = []string{
+	"system:serviceaccount:kube-system:generic-garbage-collector",
+	"system:serviceaccount:kube-system:namespace-controller",
+	"system:kube-controller-manager",
+}
+
+const ERROR_FMT_PROTECTED_SECRET = "secret '%s' is managed by ecr-secret-operator%s and cannot be changed or deleted by '%s'"
+
+var secretLog = logf.Log.WithName("secret-protection")
+
+// The webhook marker cannot give an object selector, so config/webhook and the helm chart add one
+// for the managed label. Otherwise the webhook would be called for every secret in the cluster.
+//+kubebuilder:webhook:path=/validate-v1-secret,mutating=false,failurePolicy=ignore,sideEffects=None,groups="",resources=secrets,verbs=update;delete,versions=v1,name=vsecret.secrets.fireflycons.io,admissionReviewVersions=v1
+
+// SecretProtector rejects changes to secrets generated by the operator, other than by the operator
+// itself or by members of a break-glass group. Merged and orphaned secrets are managed by users,
+// so are not protected.
+type SecretProtector struct {
+	// User name of the operator's service account
+	OperatorUsername string
+	// Groups whose members may change or delete the secrets
+	BreakGlassGroups []string
+	decoder          *admission.Decoder
+}
+
+// InjectDecoder injects the decoder
+func (s *SecretProtector) InjectDecoder(d *admission.Decoder) error {
+	s.decoder = d
+	return nil
+}
+
+// Handle allows or denies the update or delete of a secret
+func (s *SecretProtector) Handle(ctx context.Context, req admission.Request) admission.Response {
+
+	if req.Operation != admissionv1.Update && req.Operation != admissionv1.Delete {
+		return admission.Allowed("")
+	}
+
+	secret := &corev1.Secret{}
+
+	if err := s.decoder.DecodeRaw(req.OldObject, secret); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if !isProtectedSecret(secret) {
+		return admission.Allowed("secret is not managed by the operator")
+	}
+
+	username := req.UserInfo.Username
+
+	if username == s.OperatorUsername {
+		return admission.Allowed("operator")
+	}
+
+	for _, user := range systemUsers {
+		if username == user {
+			return admission.Allowed("kubernetes controller")
+		}
+	}
+
+	for _, group := range req.UserInfo.Groups {
+		for _, breakGlass := range s.BreakGlassGroups {
+			if group == breakGlass {
+				secretLog.Info("Break-glass change to managed secret", "operation", req.Operation, "namespace", req.Namespace, "secret", req.Name, "user", username, "group", group)
+				return admission.Allowed("break-glass group")
+			}
+		}
+	}
+
+	secretLog.Info("Denied change to managed secret", "operation", req.Operation, "namespace", req.Namespace, "secret", req.Name, "user", username, "groups", req.UserInfo.Groups)
+
+	return admission.Denied(fmt.Sprintf(ERROR_FMT_PROTECTED_SECRET, req.Name, ownerDescription(secret), username))
+}
+
+// Secrets generated by the operator carry its UUID annotation
+func isProtectedSecret(secret *corev1.Secret) bool {
+
+	if _, ok := secret.Annotations[ksecret.ANNOTATION_UID]; !ok {
+		return false
+	}
+
+	if _, orphaned := secret.Annotations[ksecret.ANNOTATION_ORPHANED]; orphaned {
+		return false
+	}
+
+	return !ksecret.IsMerged(secret)
+}
+
+// Describe the ECRSecret that owns the secret, so the user knows what to change instead
+func ownerDescription(secret *corev1.Secret) string {
+
+	if owner := metav1.GetControllerOf(secret); owner != nil {
+		return fmt.Sprintf(" for %s '%s'", owner.Kind, owner.Name)
+	}
+
+	return ""
+}
@@ -0,0 +1,783 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Admission webhooks for core types
+package webhooks
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
+	"github.com/fireflycons/ecr-secret-operator/internal/ksecret"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	TEST_NAMESPACE = "test-ns"
+	TEST_REGISTRY  = "123456789012.dkr.ecr.us-east-1.amazonaws.com"
+)
+
+func TestWebhooks(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Webhooks Suite")
+}
+
+func newNamespace(mode string) *corev1.Namespace {
+
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: TEST_NAMESPACE,
+		},
+	}
+
+	if mode != "" {
+		namespace.Labels = map[string]string{LABEL_INJECT_PULL_SECRETS: mode}
+	}
+
+	return namespace
+}
+
+func newECRSecret(name string, format secretsv1.SecretFormat) *secretsv1.ECRSecret {
+
+	return &secretsv1.ECRSecret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: TEST_NAMESPACE,
+		},
+		Spec: secretsv1.ECRSecretSpec{
+			Registry: TEST_REGISTRY,
+			Format:   format,
+		},
+	}
+}
+
+func newPod(image string, pullSecrets ...string) *corev1.Pod {
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: TEST_NAMESPACE,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: image},
+			},
+		},
+	}
+
+	for _, name := range pullSecrets {
+		pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+	}
+
+	return pod
+}
+
+func newRequest(pod *corev1.Pod) admission.Request {
+
+	raw, err := json.Marshal(pod)
+	Expect(err).NotTo(HaveOccurred())
+
+	return admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Create,
+			Namespace: pod.Namespace,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+var _ = Describe("Pod Pull Secrets", func() {
+
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(secretsv1.AddToScheme(scheme))
+
+	newInjector := func(dryRun bool, objects ...client.Object) *PodPullSecretInjector {
+
+		decoder, err := admission.NewDecoder(scheme)
+		Expect(err).NotTo(HaveOccurred())
+
+		injector := &PodPullSecretInjector{
+			Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+			DryRun: dryRun,
+		}
+
+		Expect(injector.InjectDecoder(decoder)).To(Succeed())
+
+		return injector
+	}
+
+	Context("Handle", func() {
+
+		It("Should add the pull secret to a pod in an opted in namespace", func() {
+			injector := newInjector(false, newNamespace(INJECT_ENABLED), newECRSecret("ecr", secretsv1.SecretFormatDockerConfigJson))
+
+			resp := injector.Handle(context.Background(), newRequest(newPod(TEST_REGISTRY+"/app:latest")))
+
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(HaveLen(1))
+			Expect(resp.Patches[0].Path).To(Equal("/spec/imagePullSecrets"))
+			Expect(resp.Patches[0].Value).To(Equal([]interface{}{map[string]interface{}{"name": "ecr-secret"}}))
+		})
+
+		It("Should not change a pod in a namespace that has not opted in", func() {
+			injector := newInjector(false, newNamespace(""), newECRSecret("ecr", secretsv1.SecretFormatDockerConfigJson))
+
+			resp := injector.Handle(context.Background(), newRequest(newPod(TEST_REGISTRY+"/app:latest")))
+
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+
+		It("Should only warn in a dry run namespace", func() {
+			injector := newInjector(false, newNamespace(INJECT_DRY_RUN), newECRSecret("ecr", secretsv1.SecretFormatDockerConfigJson))
+
+			resp := injector.Handle(context.Background(), newRequest(newPod(TEST_REGISTRY+"/app:latest")))
+
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+			Expect(resp.Warnings).To(HaveLen(1))
+			Expect(resp.Warnings[0]).To(ContainSubstring("ecr-secret"))
+		})
+
+		It("Should only warn when the injector is in dry run mode", func() {
+			injector := newInjector(true, newNamespace(INJECT_ENABLED), newECRSecret("ecr", secretsv1.SecretFormatDockerConfigJson))
+
+			resp := injector.Handle(context.Background(), newRequest(newPod(TEST_REGISTRY+"/app:latest")))
+
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+			Expect(resp.Warnings).To(HaveLen(1))
+		})
+
+		It("Should not duplicate an existing pull secret", func() {
+			injector := newInjector(false, newNamespace(INJECT_ENABLED), newECRSecret("ecr", secretsv1.SecretFormatDockerConfigJson))
+
+			resp := injector.Handle(context.Background(), newRequest(newPod(TEST_REGISTRY+"/app:latest", "ecr-secret")))
+
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+
+		It("Should not change a pod that uses other registries", func() {
+			injector := newInjector(false, newNamespace(INJECT_ENABLED), newECRSecret("ecr", secretsv1.SecretFormatDockerConfigJson))
+
+			resp := injector.Handle(context.Background(), newRequest(newPod("nginx:latest")))
+
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+	})
+
+	Context("getMissingPullSecrets", func() {
+
+		It("Should ignore ECRSecrets whose format is not a pull secret", func() {
+			ecrSecrets := []secretsv1.ECRSecret{
+				*newECRSecret("opaque", secretsv1.SecretFormatOpaque),
+				*newECRSecret("flux", secretsv1.SecretFormatFlux),
+			}
+
+			Expect(getMissingPullSecrets(newPod(TEST_REGISTRY+"/app:latest"), ecrSecrets)).To(Equal([]string{"flux-secret"}))
+		})
+
+		It("Should match a registry alias", func() {
+			ecrSecret := newECRSecret("ecr", "")
+			ecrSecret.Spec.RegistryAliases = []secretsv1.RegistryAlias{"https://ecr.example.com"}
+
+			Expect(getMissingPullSecrets(newPod("ecr.example.com/app:latest"), []secretsv1.ECRSecret{*ecrSecret})).To(Equal([]string{"ecr-secret"}))
+		})
+	})
+})
+
+// Counts the admission requests the API server sends for each namespace, and fails
+// those for the namespaces in fail, so that what reaches the webhook can be seen
+type recordingHandler struct {
+	handler  admission.Handler
+	fail     map[string]bool
+	lock     sync.Mutex
+	requests map[string]int
+}
+
+func (r *recordingHandler) Handle(ctx context.Context, req admission.Request) admission.Response {
+
+	r.lock.Lock()
+	r.requests[req.Namespace]++
+	r.lock.Unlock()
+
+	if r.fail[req.Namespace] {
+		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("failing requests for namespace %s", req.Namespace))
+	}
+
+	return r.handler.Handle(ctx, req)
+}
+
+// InjectDecoder injects the decoder into the recorded handler
+func (r *recordingHandler) InjectDecoder(d *admission.Decoder) error {
+	_, err := admission.InjectDecoderInto(d, r.handler)
+	return err
+}
+
+func (r *recordingHandler) count(namespace string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requests[namespace]
+}
+
+// Read the YAML document of the given kind from a multi-document manifest
+func readManifest(path, kind string, into interface{}) {
+
+	content, err := os.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+
+	for _, document := range strings.Split(string(content), "\n---\n") {
+		typeMeta := metav1.TypeMeta{}
+		Expect(yaml.Unmarshal([]byte(document), &typeMeta)).To(Succeed())
+
+		if typeMeta.Kind == kind {
+			Expect(yaml.Unmarshal([]byte(document), into)).To(Succeed())
+			return
+		}
+	}
+
+	Fail(fmt.Sprintf("no %s in %s", kind, path))
+}
+
+// The pod webhook as it is installed: generated from the marker, with the
+// namespace selector the webhook kustomization patches in
+func podWebhookConfiguration() *admissionregistrationv1.MutatingWebhookConfiguration {
+
+	const name = "mpod.secrets.fireflycons.io"
+
+	generated := admissionregistrationv1.MutatingWebhookConfiguration{}
+	readManifest(filepath.Join("..", "..", "config", "webhook", "manifests.yaml"), "MutatingWebhookConfiguration", &generated)
+
+	patch := admissionregistrationv1.MutatingWebhookConfiguration{}
+	readManifest(filepath.Join("..", "..", "config", "webhook", "namespace_selector_patch.yaml"), "MutatingWebhookConfiguration", &patch)
+
+	configuration := generated.DeepCopy()
+	configuration.Webhooks = nil
+
+	for _, hook := range generated.Webhooks {
+		if hook.Name == name {
+			configuration.Webhooks = append(configuration.Webhooks, hook)
+		}
+	}
+
+	Expect(configuration.Webhooks).To(HaveLen(1))
+	Expect(patch.Webhooks).To(HaveLen(1))
+	Expect(patch.Webhooks[0].Name).To(Equal(name))
+	configuration.Webhooks[0].NamespaceSelector = patch.Webhooks[0].NamespaceSelector
+
+	return configuration
+}
+
+var _ = Describe("Pod Pull Secrets Webhook Server", Ordered, func() {
+
+	const (
+		enabledNamespace    = "pods-enabled"
+		dryRunNamespace     = "pods-dry-run"
+		unlabelledNamespace = "pods-unlabelled"
+		disabledNamespace   = "pods-disabled"
+		failingNamespace    = "pods-failing"
+	)
+
+	var (
+		testEnv   *envtest.Environment
+		k8sClient client.Client
+		recorder  *recordingHandler
+		cancel    context.CancelFunc
+	)
+
+	BeforeAll(func() {
+
+		logf.SetLogger(zap.New(zap.WriteTo(GinkgoWriter), zap.UseDevMode(true)))
+
+		By("bootstrapping test environment with the pod webhook installed")
+		env := &envtest.Environment{
+			CRDDirectoryPaths:     []string{filepath.Join("..", "..", "config", "crd", "bases")},
+			ErrorIfCRDPathMissing: true,
+			WebhookInstallOptions: envtest.WebhookInstallOptions{
+				MutatingWebhooks: []*admissionregistrationv1.MutatingWebhookConfiguration{podWebhookConfiguration()},
+			},
+		}
+
+		cfg, err := env.Start()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg).NotTo(BeNil())
+
+		// Only stopped once started, as stopping a control plane that failed to start panics
+		testEnv = env
+
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(secretsv1.AddToScheme(scheme))
+
+		options := &testEnv.WebhookInstallOptions
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme:             scheme,
+			Host:               options.LocalServingHost,
+			Port:               options.LocalServingPort,
+			CertDir:            options.LocalServingCertDir,
+			MetricsBindAddress: "0",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		k8sClient, err = client.New(cfg, client.Options{Scheme: scheme})
+		Expect(err).NotTo(HaveOccurred())
+
+		recorder = &recordingHandler{
+			handler:  &PodPullSecretInjector{Client: k8sClient},
+			fail:     map[string]bool{failingNamespace: true},
+			requests: map[string]int{},
+		}
+
+		mgr.GetWebhookServer().Register(POD_PULL_SECRETS_PATH, &webhook.Admission{Handler: recorder})
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+
+		go func() {
+			defer GinkgoRecover()
+			Expect(mgr.Start(ctx)).To(Succeed())
+		}()
+
+		By("waiting for the webhook server to serve")
+		dialer := &net.Dialer{Timeout: time.Second}
+		address := fmt.Sprintf("%s:%d", options.LocalServingHost, options.LocalServingPort)
+		Eventually(func() error {
+			conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}).Should(Succeed())
+
+		labels := map[string]string{
+			enabledNamespace:    INJECT_ENABLED,
+			dryRunNamespace:     INJECT_DRY_RUN,
+			unlabelledNamespace: "",
+			disabledNamespace:   "disabled",
+			failingNamespace:    INJECT_ENABLED,
+		}
+
+		for name, mode := range labels {
+			namespace := newNamespace(mode)
+			namespace.Name = name
+			Expect(k8sClient.Create(context.Background(), namespace)).To(Succeed())
+
+			ecrSecret := newECRSecret("ecr", secretsv1.SecretFormatDockerConfigJson)
+			ecrSecret.Namespace = name
+			Expect(k8sClient.Create(context.Background(), ecrSecret)).To(Succeed())
+		}
+	})
+
+	AfterAll(func() {
+		By("tearing down the test environment")
+		if cancel != nil {
+			cancel()
+		}
+		if testEnv != nil {
+			Expect(testEnv.Stop()).To(Succeed())
+		}
+	})
+
+	createPod := func(namespace string) *corev1.Pod {
+		pod := newPod(TEST_REGISTRY + "/app:latest")
+		pod.Namespace = namespace
+		Expect(k8sClient.Create(context.Background(), pod)).To(Succeed())
+		return pod
+	}
+
+	It("Should add the pull secret to a pod created in an opted in namespace", func() {
+		pod := createPod(enabledNamespace)
+
+		Expect(recorder.count(enabledNamespace)).To(Equal(1))
+		Expect(pod.Spec.ImagePullSecrets).To(Equal([]corev1.LocalObjectReference{{Name: "ecr-secret"}}))
+	})
+
+	It("Should send pods in a dry run namespace to the webhook without changing them", func() {
+		pod := createPod(dryRunNamespace)
+
+		Expect(recorder.count(dryRunNamespace)).To(Equal(1))
+		Expect(pod.Spec.ImagePullSecrets).To(BeEmpty())
+	})
+
+	It("Should not send pods in a namespace without the label to the webhook", func() {
+		pod := createPod(unlabelledNamespace)
+
+		Expect(recorder.count(unlabelledNamespace)).To(BeZero())
+		Expect(pod.Spec.ImagePullSecrets).To(BeEmpty())
+	})
+
+	It("Should not send pods in a namespace with another label value to the webhook", func() {
+		pod := createPod(disabledNamespace)
+
+		Expect(recorder.count(disabledNamespace)).To(BeZero())
+		Expect(pod.Spec.ImagePullSecrets).To(BeEmpty())
+	})
+
+	It("Should still create the pod when the webhook fails", func() {
+		pod := createPod(failingNamespace)
+
+		Expect(recorder.count(failingNamespace)).To(Equal(1))
+		Expect(pod.Spec.ImagePullSecrets).To(BeEmpty())
+	})
+})
+
+var _ = Describe("ECRSecret Validation", func() {
+
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(secretsv1.AddToScheme(scheme))
+
+	ctx := context.Background()
+
+	var configFile string
+
+	BeforeEach(func() {
+		configFile = filepath.Join(GinkgoT().TempDir(), "config.toml")
+		Expect(os.WriteFile(configFile, []byte(`[123456789012]
+access_key = "AKAIEXAMPLE"
+secret_key = "dsfdsfdfEXAMPLE"`), 0600)).To(Succeed())
+	})
+
+	newValidator := func(objects ...client.Object) *ECRSecretValidator {
+
+		return &ECRSecretValidator{
+			Client:     fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+			ConfigFile: configFile,
+		}
+	}
+
+	newSecret := func(name string) *corev1.Secret {
+
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: TEST_NAMESPACE,
+			},
+		}
+	}
+
+	expectInvalid := func(err error, message string) {
+		Expect(apierrs.IsInvalid(err)).To(BeTrue(), "%v", err)
+		Expect(err.Error()).To(ContainSubstring(message))
+	}
+
+	It("Should default the secret name", func() {
+		ecrSecret := newECRSecret("ecr", "")
+		ecrSecret.Default()
+
+		Expect(ecrSecret.Spec.SecretName).To(Equal("ecr-secret"))
+
+		ecrSecret.Spec.SecretName = "custom"
+		ecrSecret.Default()
+
+		Expect(ecrSecret.Spec.SecretName).To(Equal("custom"))
+	})
+
+	It("Should accept a valid ECRSecret", func() {
+		validator := newValidator(newNamespace(""))
+
+		Expect(validator.ValidateCreate(ctx, newECRSecret("ecr", ""))).To(Succeed())
+	})
+
+	It("Should reject an account with no credentials", func() {
+		validator := newValidator(newNamespace(""))
+		ecrSecret := newECRSecret("ecr", "")
+		ecrSecret.Spec.Registry = "999999999999.dkr.ecr.us-east-1.amazonaws.com"
+
+		expectInvalid(validator.ValidateCreate(ctx, ecrSecret), fmt.Sprintf(ERROR_FMT_NO_CREDENTIALS, "999999999999"))
+	})
+
+	It("Should reject an account not allowed in the namespace", func() {
+		namespace := newNamespace("")
+		namespace.Annotations = map[string]string{ANNOTATION_ALLOWED_ACCOUNTS: "111111111111, 222222222222"}
+		validator := newValidator(namespace)
+
+		expectInvalid(validator.ValidateCreate(ctx, newECRSecret("ecr", "")), fmt.Sprintf(ERROR_FMT_ACCOUNT_NOT_ALLOWED, "123456789012", TEST_NAMESPACE))
+
+		namespace.Annotations[ANNOTATION_ALLOWED_ACCOUNTS] = "111111111111, 123456789012"
+		validator = newValidator(namespace)
+
+		Expect(validator.ValidateCreate(ctx, newECRSecret("ecr", ""))).To(Succeed())
+	})
+
+	It("Should reject a secret name generated by another ECRSecret", func() {
+		other := newECRSecret("other", "")
+		other.Spec.SecretName = "shared"
+		validator := newValidator(newNamespace(""), other)
+
+		ecrSecret := newECRSecret("ecr", "")
+		ecrSecret.Spec.SecretName = "shared"
+
+		expectInvalid(validator.ValidateCreate(ctx, ecrSecret), fmt.Sprintf(ERROR_FMT_ECRSECRET_COLLISION, "shared", "other"))
+	})
+
+	It("Should reject overwriting a secret the operator does not manage", func() {
+		validator := newValidator(newNamespace(""), newSecret("ecr-secret"))
+
+		expectInvalid(validator.ValidateCreate(ctx, newECRSecret("ecr", "")), fmt.Sprintf(ERROR_FMT_SECRET_COLLISION, "ecr-secret"))
+	})
+
+	It("Should allow merging into a secret the operator does not manage", func() {
+		validator := newValidator(newNamespace(""), newSecret("ecr-secret"))
+		ecrSecret := newECRSecret("ecr", "")
+		ecrSecret.Spec.Merge = true
+
+		Expect(validator.ValidateCreate(ctx, ecrSecret)).To(Succeed())
+	})
+
+	It("Should allow a secret owned by the ECRSecret or orphaned", func() {
+		ecrSecret := newECRSecret("ecr", "")
+		ecrSecret.UID = "ecr-uid"
+
+		owned := newSecret("ecr-secret")
+		Expect(controllerutil.SetControllerReference(ecrSecret, owned, scheme)).To(Succeed())
+
+		Expect(newValidator(newNamespace(""), owned).ValidateCreate(ctx, ecrSecret)).To(Succeed())
+
+		orphaned := newSecret("ecr-secret")
+		orphaned.Annotations = map[string]string{ksecret.ANNOTATION_ORPHANED: "true"}
+
+		Expect(newValidator(newNamespace(""), orphaned).ValidateCreate(ctx, ecrSecret)).To(Succeed())
+	})
+
+	It("Should only validate changed fields on update", func() {
+		namespace := newNamespace("")
+		namespace.Annotations = map[string]string{ANNOTATION_ALLOWED_ACCOUNTS: "111111111111"}
+		validator := newValidator(namespace)
+
+		oldSecret := newECRSecret("ecr", "")
+		newSecret := oldSecret.DeepCopy()
+		newSecret.Spec.Suspend = true
+
+		Expect(validator.ValidateUpdate(ctx, oldSecret, newSecret)).To(Succeed())
+
+		newSecret.Spec.Registry = "123456789012.dkr.ecr.eu-west-1.amazonaws.com"
+
+		expectInvalid(validator.ValidateUpdate(ctx, oldSecret, newSecret), fmt.Sprintf(ERROR_FMT_ACCOUNT_NOT_ALLOWED, "123456789012", TEST_NAMESPACE))
+	})
+
+	Context("Delete", func() {
+
+		newServiceAccount := func(pullSecrets ...string) *corev1.ServiceAccount {
+
+			serviceAccount := &corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-sa",
+					Namespace: TEST_NAMESPACE,
+				},
+			}
+
+			for _, name := range pullSecrets {
+				serviceAccount.ImagePullSecrets = append(serviceAccount.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+			}
+
+			return serviceAccount
+		}
+
+		expectForbidden := func(err error, pods, serviceAccounts int) {
+			Expect(apierrs.IsForbidden(err)).To(BeTrue(), "%v", err)
+			Expect(err.Error()).To(ContainSubstring(fmt.Sprintf(ERROR_FMT_SECRET_IN_USE, "ecr-secret", pods, serviceAccounts, secretsv1.AnnotationForceDelete)))
+		}
+
+		It("Should allow deleting an ECRSecret whose secret is not referenced", func() {
+			validator := newValidator(newNamespace(""), newPod(TEST_REGISTRY+"/app:latest", "other-secret"), newServiceAccount())
+
+			Expect(validator.ValidateDelete(ctx, newECRSecret("ecr", ""))).To(Succeed())
+		})
+
+		It("Should refuse to delete an ECRSecret whose secret is referenced", func() {
+			validator := newValidator(newNamespace(""), newPod(TEST_REGISTRY+"/app:latest", "ecr-secret"), newServiceAccount("ecr-secret"))
+
+			expectForbidden(validator.ValidateDelete(ctx, newECRSecret("ecr", "")), 1, 1)
+		})
+
+		It("Should ignore completed pods", func() {
+			pod := newPod(TEST_REGISTRY+"/app:latest", "ecr-secret")
+			pod.Status.Phase = corev1.PodSucceeded
+			validator := newValidator(newNamespace(""), pod, newServiceAccount("ecr-secret"))
+
+			expectForbidden(validator.ValidateDelete(ctx, newECRSecret("ecr", "")), 0, 1)
+		})
+
+		It("Should ignore service accounts the operator linked the secret to", func() {
+			serviceAccount := newServiceAccount("ecr-secret")
+			ksecret.SetAddedPullSecrets(serviceAccount, []string{"ecr-secret"})
+			validator := newValidator(newNamespace(""), serviceAccount)
+
+			Expect(validator.ValidateDelete(ctx, newECRSecret("ecr", ""))).To(Succeed())
+		})
+
+		It("Should allow a forced delete", func() {
+			validator := newValidator(newNamespace(""), newPod(TEST_REGISTRY+"/app:latest", "ecr-secret"))
+			ecrSecret := newECRSecret("ecr", "")
+			ecrSecret.Annotations = map[string]string{secretsv1.AnnotationForceDelete: "true"}
+
+			Expect(validator.ValidateDelete(ctx, ecrSecret)).To(Succeed())
+		})
+
+		It("Should allow the operator to delete an ECRSecret whose secret is referenced", func() {
+			const operator = "system:serviceaccount:ecr-secret-operator-system:ecr-secret-operator-controller-manager"
+			validator := newValidator(newNamespace(""), newPod(TEST_REGISTRY+"/app:latest", "ecr-secret"))
+			validator.OperatorUsername = operator
+
+			asUser := func(username string) context.Context {
+				return admission.NewContextWithRequest(ctx, admission.Request{
+					AdmissionRequest: admissionv1.AdmissionRequest{
+						Operation: admissionv1.Delete,
+						UserInfo:  authenticationv1.UserInfo{Username: username},
+					},
+				})
+			}
+
+			Expect(validator.ValidateDelete(asUser(operator), newECRSecret("ecr", ""))).To(Succeed())
+			expectForbidden(validator.ValidateDelete(asUser("jane"), newECRSecret("ecr", "")), 1, 0)
+		})
+
+		It("Should allow deleting an ECRSecret in a namespace being deleted", func() {
+			namespace := newNamespace("")
+			now := metav1.Now()
+			namespace.DeletionTimestamp = &now
+			namespace.Finalizers = []string{"kubernetes"}
+			validator := newValidator(namespace, newPod(TEST_REGISTRY+"/app:latest", "ecr-secret"))
+
+			Expect(validator.ValidateDelete(ctx, newECRSecret("ecr", ""))).To(Succeed())
+		})
+	})
+})
+
+var _ = Describe("Secret Protection", func() {
+
+	const OPERATOR = "system:serviceaccount:ecr-secret-operator-system:ecr-secret-operator-controller-manager"
+
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+
+	newProtector := func() *SecretProtector {
+
+		decoder, err := admission.NewDecoder(scheme)
+		Expect(err).NotTo(HaveOccurred())
+
+		protector := &SecretProtector{
+			OperatorUsername: OPERATOR,
+			BreakGlassGroups: []string{"platform-admins"},
+		}
+
+		Expect(protector.InjectDecoder(decoder)).To(Succeed())
+
+		return protector
+	}
+
+	newManagedSecret := func(annotations map[string]string) *corev1.Secret {
+
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "ecr-secret",
+				Namespace:   TEST_NAMESPACE,
+				Annotations: map[string]string{ksecret.ANNOTATION_UID: "00000000-0000-0000-0000-000000000000"},
+			},
+		}
+
+		for k, v := range annotations {
+			secret.Annotations[k] = v
+		}
+
+		return secret
+	}
+
+	newSecretRequest := func(operation admissionv1.Operation, secret *corev1.Secret, username string, groups ...string) admission.Request {
+
+		raw, err := json.Marshal(secret)
+		Expect(err).NotTo(HaveOccurred())
+
+		return admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: operation,
+				Name:      secret.Name,
+				Namespace: secret.Namespace,
+				OldObject: runtime.RawExtension{Raw: raw},
+				UserInfo:  authenticationv1.UserInfo{Username: username, Groups: groups},
+			},
+		}
+	}
+
+	DescribeTable("Should allow or deny changes to a secret",
+		func(operation admissionv1.Operation, annotations map[string]string, username string, groups []string, allowed bool) {
+			secret := newManagedSecret(annotations)
+
+			if annotations == nil {
+				secret.Annotations = nil
+			}
+
+			resp := newProtector().Handle(context.Background(), newSecretRequest(operation, secret, username, groups...))
+
+			Expect(resp.Allowed).To(Equal(allowed))
+		},
+		Entry("user deleting a managed secret", admissionv1.Delete, map[string]string{}, "jane", []string{"developers"}, false),
+		Entry("user updating a managed secret", admissionv1.Update, map[string]string{}, "jane", nil, false),
+		Entry("operator updating a managed secret", admissionv1.Update, map[string]string{}, OPERATOR, nil, true),
+		Entry("break-glass group deleting a managed secret", admissionv1.Delete, map[string]string{}, "jane", []string{"developers", "platform-admins"}, true),
+		Entry("garbage collector deleting a managed secret", admissionv1.Delete, map[string]string{}, "system:serviceaccount:kube-system:generic-garbage-collector", nil, true),
+		Entry("user deleting an orphaned secret", admissionv1.Delete, map[string]string{ksecret.ANNOTATION_ORPHANED: "2023-01-01T00:00:00Z"}, "jane", nil, true),
+		Entry("user deleting another secret", admissionv1.Delete, nil, "jane", nil, true),
+	)
+
+	It("Should name the owning ECRSecret when denying", func() {
+		secret := newManagedSecret(nil)
+		secret.OwnerReferences = []metav1.OwnerReference{
+			*metav1.NewControllerRef(newECRSecret("ecr", ""), secretsv1.GroupVersion.WithKind("ECRSecret")),
+		}
+
+		resp := newProtector().Handle(context.Background(), newSecretRequest(admissionv1.Delete, secret, "jane"))
+
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(Equal(fmt.Sprintf(ERROR_FMT_PROTECTED_SECRET, "ecr-secret", " for ECRSecret 'ecr'", "jane")))
+	})
+})
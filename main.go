@@ -17,26 +17,37 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
 
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/conversion"
 
+	secretsv1 "github.com/fireflycons/ecr-secret-operator/api/v1"
 	secretsv1beta1 "github.com/fireflycons/ecr-secret-operator/api/v1beta1"
 	"github.com/fireflycons/ecr-secret-operator/controllers"
+	"github.com/fireflycons/ecr-secret-operator/internal/certs"
+	"github.com/fireflycons/ecr-secret-operator/internal/webhooks"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -45,10 +56,22 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+// Values of --webhook-certs
+const (
+	WEBHOOK_CERTS_OPERATOR = "operator"
+	WEBHOOK_CERTS_EXTERNAL = "external"
+)
+
+// Path the CRDs' conversion webhook is served on
+const CONVERSION_PATH = "/convert"
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
+
 	utilruntime.Must(secretsv1beta1.AddToScheme(scheme))
+	utilruntime.Must(secretsv1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -58,6 +81,24 @@ func main() {
 	var probeAddr string
 	var configFile string
 	var maxAge time.Duration
+	var enablePodWebhook bool
+	var podWebhookDryRun bool
+	var enableRegistryDiscovery bool
+	var discoveryGracePeriod time.Duration
+	var enablePullFailureRefresh bool
+	var pullFailureRefreshInterval time.Duration
+	var enableUsageTracking bool
+	var unusedAfter time.Duration
+	var enableECRSecretWebhooks bool
+	var enableConversionWebhook bool
+	var enableSecretProtection bool
+	var breakGlassGroups string
+	var operatorServiceAccount string
+	var webhookCerts string
+	var webhookServiceName string
+	var webhookCertSecret string
+	var mutatingWebhookConfiguration string
+	var validatingWebhookConfiguration string
 
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
@@ -66,6 +107,42 @@ func main() {
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.StringVar(&configFile, "config-file", "", "The path to the configuration file containing AWS credentials")
 	flag.DurationVar(&maxAge, "max-age", time.Hour*8, "The maximum age the secret can be before being rotated.")
+	flag.BoolVar(&enablePodWebhook, "enable-pod-webhook", false,
+		"Serve the webhook that adds ECR pull secrets to pods in namespaces that opt in. Requires webhook serving certificates.")
+	flag.BoolVar(&podWebhookDryRun, "pod-webhook-dry-run", false,
+		"Log the pull secrets the pod webhook would add, without changing any pods.")
+	flag.BoolVar(&enableRegistryDiscovery, "enable-registry-discovery", false,
+		"Create ECRSecrets for the ECR registries used by workloads in namespaces that opt in.")
+	flag.DurationVar(&discoveryGracePeriod, "discovery-grace-period", time.Hour,
+		"How long to keep a discovered ECRSecret after no workload uses its registry.")
+	flag.BoolVar(&enablePullFailureRefresh, "enable-pull-failure-refresh", false,
+		"Refresh an ECRSecret straight away when a pod using its secret fails to pull an image because the registry rejected the credentials.")
+	flag.DurationVar(&pullFailureRefreshInterval, "pull-failure-refresh-interval", time.Minute*5,
+		"The minimum time between refreshes of an ECRSecret triggered by image pull failures.")
+	flag.BoolVar(&enableUsageTracking, "enable-usage-tracking", false,
+		"Count the pods and service accounts that reference each ECRSecret's secret, in its status and as metrics.")
+	flag.DurationVar(&unusedAfter, "unused-after", time.Hour*24*7,
+		"How long an ECRSecret's secret must go unreferenced before the ECRSecret is flagged Unused.")
+	flag.BoolVar(&enableECRSecretWebhooks, "enable-ecrsecret-webhooks", false,
+		"Serve the webhooks that default and validate ECRSecrets.")
+	flag.BoolVar(&enableConversionWebhook, "enable-conversion-webhook", false,
+		"Serve the webhook that converts ECRSecrets and ClusterECRSecrets between API versions, and set their CRDs to use it. Requires webhook serving certificates.")
+	flag.BoolVar(&enableSecretProtection, "enable-secret-protection-webhook", false,
+		"Serve the webhook that rejects changes to and deletion of secrets generated by the operator, other than by the operator or a break-glass group.")
+	flag.StringVar(&breakGlassGroups, "break-glass-groups", "",
+		"Comma separated groups whose members may change or delete secrets protected by the secret protection webhook.")
+	flag.StringVar(&operatorServiceAccount, "operator-service-account", "ecr-secret-operator-controller-manager",
+		"The name of the service account the operator runs as. Its changes to secrets are allowed by the secret protection webhook, and its deletes of ECRSecrets by the ECRSecret webhook.")
+	flag.StringVar(&webhookCerts, "webhook-certs", WEBHOOK_CERTS_OPERATOR,
+		"Who provides the webhook serving certificates. 'operator' to generate and rotate them, or 'external' where they are mounted, e.g. by cert-manager.")
+	flag.StringVar(&webhookServiceName, "webhook-service-name", "ecr-secret-operator-webhook-service",
+		"The name of the service the webhooks are reached by. Used for the operator's webhook certificates.")
+	flag.StringVar(&webhookCertSecret, "webhook-cert-secret", "ecr-secret-operator-webhook-cert",
+		"The name of the secret in which the operator keeps its webhook certificates.")
+	flag.StringVar(&mutatingWebhookConfiguration, "mutating-webhook-configuration", "ecr-secret-operator-mutating-webhook-configuration",
+		"The name of the mutating webhook configuration to inject the operator's webhook CA into.")
+	flag.StringVar(&validatingWebhookConfiguration, "validating-webhook-configuration", "ecr-secret-operator-validating-webhook-configuration",
+		"The name of the validating webhook configuration to inject the operator's webhook CA into.")
 
 	opts := zap.Options{
 		Development: true,
@@ -81,10 +158,19 @@ func main() {
 		os.Exit(1)
 	}
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	if webhookCerts != WEBHOOK_CERTS_OPERATOR && webhookCerts != WEBHOOK_CERTS_EXTERNAL {
+		setupLog.Error(nil, fmt.Sprintf("unable to start manager - invalid --webhook-certs '%s'.", webhookCerts))
+		os.Exit(1)
+	}
+
+	restConfig := ctrl.GetConfigOrDie()
+	webhookCertDir := filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs")
+
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
+		CertDir:                webhookCertDir,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "0445ae89.fireflycons.io",
@@ -114,8 +200,103 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "ECRSecret")
 		os.Exit(1)
 	}
+	if err = (&controllers.ClusterECRSecretReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterECRSecret")
+		os.Exit(1)
+	}
+	if enableRegistryDiscovery {
+		if err = (&controllers.RegistryDiscoveryReconciler{
+			Client:      mgr.GetClient(),
+			Scheme:      mgr.GetScheme(),
+			ConfigFile:  configFile,
+			GracePeriod: discoveryGracePeriod,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "RegistryDiscovery")
+			os.Exit(1)
+		}
+	}
+	if enablePullFailureRefresh {
+		if err = (&controllers.PullFailureReconciler{
+			Client:      mgr.GetClient(),
+			Scheme:      mgr.GetScheme(),
+			MinInterval: pullFailureRefreshInterval,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "PullFailure")
+			os.Exit(1)
+		}
+	}
+	if enableUsageTracking {
+		if err = (&controllers.UsageReconciler{
+			Client:      mgr.GetClient(),
+			Scheme:      mgr.GetScheme(),
+			UnusedAfter: unusedAfter,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Usage")
+			os.Exit(1)
+		}
+	}
+	// The operator's own changes are let through by the secret protection webhook and the ECRSecret deletion guard
+	var operatorUsername string
+	if enableSecretProtection || enableECRSecretWebhooks {
+		namespace, err := certs.CurrentNamespace()
+
+		if err != nil {
+			setupLog.Error(err, "unable to determine the operator's service account")
+			os.Exit(1)
+		}
+
+		operatorUsername = fmt.Sprintf("system:serviceaccount:%s:%s", namespace, operatorServiceAccount)
+	}
+	if enableConversionWebhook {
+		// Registered before the ECRSecret webhooks, which would otherwise register it themselves
+		mgr.GetWebhookServer().Register(CONVERSION_PATH, &conversion.Webhook{})
+	}
+	if enableECRSecretWebhooks {
+		if err = (&secretsv1.ECRSecret{}).SetupWebhookWithManager(mgr, &webhooks.ECRSecretValidator{
+			Client:           mgr.GetClient(),
+			ConfigFile:       configFile,
+			OperatorUsername: operatorUsername,
+		}); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ECRSecret")
+			os.Exit(1)
+		}
+	}
+	if enablePodWebhook {
+		mgr.GetWebhookServer().Register(webhooks.POD_PULL_SECRETS_PATH, &webhook.Admission{
+			Handler: &webhooks.PodPullSecretInjector{
+				Client: mgr.GetClient(),
+				DryRun: podWebhookDryRun,
+			},
+		})
+	}
+	if enableSecretProtection {
+		mgr.GetWebhookServer().Register(webhooks.SECRET_PROTECTION_PATH, &webhook.Admission{
+			Handler: &webhooks.SecretProtector{
+				OperatorUsername: operatorUsername,
+				BreakGlassGroups: splitList(breakGlassGroups),
+			},
+		})
+	}
 	//+kubebuilder:scaffold:builder
 
+	if (enablePodWebhook || enableECRSecretWebhooks || enableConversionWebhook || enableSecretProtection) && webhookCerts == WEBHOOK_CERTS_OPERATOR {
+		if err = setupWebhookCerts(mgr, restConfig, webhookCertDir, webhookServiceName, webhookCertSecret,
+			mutatingWebhookConfiguration, validatingWebhookConfiguration); err != nil {
+			setupLog.Error(err, "unable to set up webhook certificates")
+			os.Exit(1)
+		}
+	}
+
+	if enableConversionWebhook {
+		if err = setupConversionWebhook(mgr, restConfig, webhookCertDir, webhookServiceName); err != nil {
+			setupLog.Error(err, "unable to set up conversion webhook")
+			os.Exit(1)
+		}
+	}
+
 	if err != nil {
 		setupLog.Error(err, "unable to create watch", "controller", "ECRSecret")
 		os.Exit(1)
@@ -135,3 +316,82 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// Generate the webhook certificates before the webhook server starts, and keep them up to date after
+func setupWebhookCerts(mgr ctrl.Manager, restConfig *rest.Config, certDir, serviceName, secretName, mutatingConfig, validatingConfig string) error {
+
+	namespace, err := certs.CurrentNamespace()
+
+	if err != nil {
+		return err
+	}
+
+	// The manager's client reads from a cache that is not started yet
+	directClient, err := client.New(restConfig, client.Options{Scheme: scheme})
+
+	if err != nil {
+		return err
+	}
+
+	certManager := &certs.Manager{
+		Client:                          directClient,
+		Namespace:                       namespace,
+		SecretName:                      secretName,
+		ServiceName:                     serviceName,
+		CertDir:                         certDir,
+		MutatingWebhookConfigurations:   []string{mutatingConfig},
+		ValidatingWebhookConfigurations: []string{validatingConfig},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err = certManager.Ensure(ctx); err != nil {
+		return err
+	}
+
+	return mgr.Add(certManager)
+}
+
+// Have the operator's CRDs convert between API versions with its conversion webhook
+func setupConversionWebhook(mgr ctrl.Manager, restConfig *rest.Config, certDir, serviceName string) error {
+
+	namespace, err := certs.CurrentNamespace()
+
+	if err != nil {
+		return err
+	}
+
+	// CRDs are not otherwise watched, so read them directly rather than caching them all
+	directClient, err := client.New(restConfig, client.Options{Scheme: scheme})
+
+	if err != nil {
+		return err
+	}
+
+	return mgr.Add(&certs.ConversionConfigurer{
+		Client:      directClient,
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		Path:        CONVERSION_PATH,
+		CertDir:     certDir,
+		CustomResourceDefinitions: []string{
+			"ecrsecrets." + secretsv1.GroupVersion.Group,
+			"clusterecrsecrets." + secretsv1.GroupVersion.Group,
+		},
+	})
+}
+
+// Split a comma separated flag value, dropping empty items
+func splitList(value string) []string {
+
+	var items []string
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}